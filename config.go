@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/schollz/boltdb-server/server"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that override the
+// config file, like BOLTDB_SERVER_LISTEN
+const envPrefix = "BOLTDB_SERVER_"
+
+// config is the configuration of the server, which is read from a YAML or
+// TOML file, then overridden by environment variables and then by flags
+type config struct {
+	Listen        string   `yaml:"listen" toml:"listen"`                 // address to listen on, like :8050
+	DB            string   `yaml:"db" toml:"db"`                         // directory of the databases
+	Compress      bool     `yaml:"compress" toml:"compress"`             // compress new values with flate, unless compression.codec is set
+	Auth          string   `yaml:"auth" toml:"auth"`                     // JSON file of users, API keys and their grants
+	SweepInterval duration `yaml:"sweep_interval" toml:"sweep_interval"` // how often expired keys and leases are swept
+
+	// ShutdownTimeout is how long to wait for requests to finish on SIGINT
+	// or SIGTERM before closing the databases
+	ShutdownTimeout duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// IdleClose is the deprecated name of Cache.IdleClose, which it is moved
+	// to when the config is loaded
+	IdleClose *duration `yaml:"idle_close,omitempty" toml:"idle_close,omitempty"`
+
+	Compression struct {
+		Codec   string `yaml:"codec" toml:"codec"`       // none, flate, gzip, zstd or snappy
+		MinSize int    `yaml:"min_size" toml:"min_size"` // values smaller than this many bytes are not compressed
+	} `yaml:"compression" toml:"compression"`
+
+	Cache struct {
+		IdleClose duration `yaml:"idle_close" toml:"idle_close"` // close databases that have not been used for this long
+		MaxOpen   int      `yaml:"max_open" toml:"max_open"`     // most databases kept open, or 0 for no limit
+		Pinned    []string `yaml:"pinned" toml:"pinned"`         // databases that stay open once they are opened
+	} `yaml:"cache" toml:"cache"`
+
+	TLS struct {
+		Cert       string `yaml:"cert" toml:"cert"`               // PEM certificate file
+		Key        string `yaml:"key" toml:"key"`                 // PEM private key file
+		ClientCA   string `yaml:"client_ca" toml:"client_ca"`     // PEM file of CAs that sign client certificates
+		ClientAuth string `yaml:"client_auth" toml:"client_auth"` // none, request or require a client certificate
+	} `yaml:"tls" toml:"tls"`
+
+	Bolt struct {
+		NoSync          bool     `yaml:"no_sync" toml:"no_sync"`                     // don't fsync after each write
+		Timeout         duration `yaml:"timeout" toml:"timeout"`                     // how long to wait for the lock on a database file
+		InitialMmapSize int      `yaml:"initial_mmap_size" toml:"initial_mmap_size"` // initial size in bytes of the memory map
+	} `yaml:"bolt" toml:"bolt"`
+
+	Limits struct {
+		MaxBodySize   int64 `yaml:"max_body_size" toml:"max_body_size"`     // largest request body in bytes
+		MaxPop        int   `yaml:"max_pop" toml:"max_pop"`                 // most keys returned by a pop
+		MaxRangeLimit int   `yaml:"max_range_limit" toml:"max_range_limit"` // largest page of a range scan
+	} `yaml:"limits" toml:"limits"`
+
+	Idempotency struct {
+		TTL      duration `yaml:"ttl" toml:"ttl"`             // how long responses to requests with an Idempotency-Key are replayed
+		MaxBytes int64    `yaml:"max_bytes" toml:"max_bytes"` // most bytes of responses kept for replays, dropping the oldest
+	} `yaml:"idempotency" toml:"idempotency"`
+
+	Log struct {
+		Level    string `yaml:"level" toml:"level"`       // trace, debug, info, warn or error
+		Requests bool   `yaml:"requests" toml:"requests"` // log every request
+	} `yaml:"log" toml:"log"`
+}
+
+// defaultConfig is the configuration without a config file
+func defaultConfig() config {
+	var c config
+	c.Listen = ":8050"
+	c.DB = path.Join(".", "dbs")
+	c.SweepInterval = duration(10 * time.Second)
+	c.Cache.IdleClose = duration(10 * time.Second)
+	c.ShutdownTimeout = duration(30 * time.Second)
+	c.Idempotency.TTL = duration(24 * time.Hour)
+	c.Idempotency.MaxBytes = 64 << 20
+	c.Log.Level = "warn"
+	c.Log.Requests = true
+	return c
+}
+
+// duration is a time.Duration written like 10s in config files
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// decodeConfigFile reads a config file over the defaults, as TOML if it has
+// a .toml extension and as YAML otherwise. Unknown settings are errors, so
+// that typos aren't ignored.
+func decodeConfigFile(c *config, filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".toml" {
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return fmt.Errorf("Problem parsing %s: %s", filename, err.Error())
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("Problem parsing %s: unknown setting '%s'", filename, undecoded[0].String())
+		}
+		return nil
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("Problem parsing %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// loadConfigFile reads a config file over the defaults, moving the settings
+// with deprecated names to their current names unless those are set too
+func loadConfigFile(c *config, filename string) error {
+	// An idle close that can't be in a valid file tells whether the file set
+	// cache.idle_close
+	idleClose := c.Cache.IdleClose
+	c.Cache.IdleClose = -1
+	err := decodeConfigFile(c, filename)
+	if c.IdleClose != nil {
+		fmt.Fprintf(os.Stderr, "%s: idle_close is deprecated, use cache.idle_close\n", filename)
+		if c.Cache.IdleClose == -1 {
+			c.Cache.IdleClose = *c.IdleClose
+		}
+		c.IdleClose = nil
+	}
+	if c.Cache.IdleClose == -1 {
+		c.Cache.IdleClose = idleClose
+	}
+	return err
+}
+
+// envSettings are the environment variables that override settings, without
+// envPrefix
+func (c *config) envSettings() map[string]func(string) error {
+	str := func(s *string) func(string) error {
+		return func(v string) error { *s = v; return nil }
+	}
+	boolean := func(b *bool) func(string) error {
+		return func(v string) (err error) { *b, err = strconv.ParseBool(v); return err }
+	}
+	list := func(l *[]string) func(string) error {
+		return func(v string) error {
+			*l = nil
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*l = append(*l, item)
+				}
+			}
+			return nil
+		}
+	}
+	integer := func(i *int) func(string) error {
+		return func(v string) (err error) { *i, err = strconv.Atoi(v); return err }
+	}
+	dur := func(d *duration) func(string) error {
+		return func(v string) error { return d.UnmarshalText([]byte(v)) }
+	}
+	return map[string]func(string) error{
+		"LISTEN":                 str(&c.Listen),
+		"DB":                     str(&c.DB),
+		"COMPRESS":               boolean(&c.Compress),
+		"AUTH":                   str(&c.Auth),
+		"COMPRESSION_CODEC":      str(&c.Compression.Codec),
+		"COMPRESSION_MIN_SIZE":   integer(&c.Compression.MinSize),
+		"SWEEP_INTERVAL":         dur(&c.SweepInterval),
+		"CACHE_IDLE_CLOSE":       dur(&c.Cache.IdleClose),
+		"CACHE_MAX_OPEN":         integer(&c.Cache.MaxOpen),
+		"CACHE_PINNED":           list(&c.Cache.Pinned),
+		"SHUTDOWN_TIMEOUT":       dur(&c.ShutdownTimeout),
+		"TLS_CERT":               str(&c.TLS.Cert),
+		"TLS_KEY":                str(&c.TLS.Key),
+		"TLS_CLIENT_CA":          str(&c.TLS.ClientCA),
+		"TLS_CLIENT_AUTH":        str(&c.TLS.ClientAuth),
+		"BOLT_NO_SYNC":           boolean(&c.Bolt.NoSync),
+		"BOLT_TIMEOUT":           dur(&c.Bolt.Timeout),
+		"BOLT_INITIAL_MMAP_SIZE": integer(&c.Bolt.InitialMmapSize),
+		"MAX_BODY_SIZE": func(v string) (err error) {
+			c.Limits.MaxBodySize, err = strconv.ParseInt(v, 10, 64)
+			return err
+		},
+		"MAX_POP":         integer(&c.Limits.MaxPop),
+		"MAX_RANGE_LIMIT": integer(&c.Limits.MaxRangeLimit),
+		"IDEMPOTENCY_TTL": dur(&c.Idempotency.TTL),
+		"IDEMPOTENCY_MAX_BYTES": func(v string) (err error) {
+			c.Idempotency.MaxBytes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		},
+		"LOG_LEVEL":    str(&c.Log.Level),
+		"LOG_REQUESTS": boolean(&c.Log.Requests),
+	}
+}
+
+// deprecatedEnv are the deprecated names of environment variables, without
+// envPrefix, and their current names, which take precedence
+var deprecatedEnv = map[string]string{
+	"IDLE_CLOSE": "CACHE_IDLE_CLOSE",
+}
+
+// applyEnv overrides settings with the environment variables that are set
+func (c *config) applyEnv() error {
+	settings := c.envSettings()
+	for old, name := range deprecatedEnv {
+		v, ok := os.LookupEnv(envPrefix + old)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s%s is deprecated, use %s%s\n", envPrefix, old, envPrefix, name)
+		if _, ok := os.LookupEnv(envPrefix + name); ok {
+			continue
+		}
+		if err := settings[name](v); err != nil {
+			return fmt.Errorf("Problem parsing %s%s: %s", envPrefix, old, err.Error())
+		}
+	}
+	for name, set := range settings {
+		v, ok := os.LookupEnv(envPrefix + name)
+		if !ok {
+			continue
+		}
+		if err := set(v); err != nil {
+			return fmt.Errorf("Problem parsing %s%s: %s", envPrefix, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// validate returns an error for the first invalid setting
+func (c config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("Invalid listen address '%s', must be like :8050 or 127.0.0.1:8050", c.Listen)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("TLS needs both a cert and a key")
+	}
+	if _, ok := clientAuthTypes[c.TLS.ClientAuth]; !ok && c.TLS.ClientAuth != "" {
+		return fmt.Errorf("Unknown tls.client_auth '%s', must be none, request or require", c.TLS.ClientAuth)
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return errors.New("tls.client_ca needs a cert and a key")
+	}
+	if c.TLS.ClientCA == "" && c.TLS.ClientAuth != "" && c.TLS.ClientAuth != "none" {
+		return errors.New("tls.client_auth needs tls.client_ca to verify client certificates")
+	}
+	if c.Cache.IdleClose <= 0 {
+		return errors.New("cache.idle_close must be positive")
+	}
+	if c.SweepInterval <= 0 {
+		return errors.New("sweep_interval must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if c.Idempotency.TTL <= 0 || c.Idempotency.MaxBytes <= 0 {
+		return errors.New("idempotency.ttl and idempotency.max_bytes must be positive")
+	}
+	return c.serverConfig().Validate()
+}
+
+// serverConfig returns the config of the server
+func (c config) serverConfig() server.Config {
+	return server.Config{
+		DBPath:          c.DB,
+		Compress:        c.Compress,
+		Codec:           c.Compression.Codec,
+		CompressMinSize: c.Compression.MinSize,
+		AuthFile:        c.Auth,
+		IdleTimeout:     time.Duration(c.Cache.IdleClose),
+		MaxOpen:         c.Cache.MaxOpen,
+		PinnedDBs:       c.Cache.Pinned,
+		SweepInterval:   time.Duration(c.SweepInterval),
+		NoSync:          c.Bolt.NoSync,
+		OpenTimeout:     time.Duration(c.Bolt.Timeout),
+		InitialMmapSize: c.Bolt.InitialMmapSize,
+		MaxBodySize:     c.Limits.MaxBodySize,
+		MaxPop:          c.Limits.MaxPop,
+		MaxRangeLimit:   c.Limits.MaxRangeLimit,
+
+		IdempotencyTTL:      time.Duration(c.Idempotency.TTL),
+		IdempotencyMaxBytes: c.Idempotency.MaxBytes,
+
+		LogLevel:    c.Log.Level,
+		LogRequests: c.Log.Requests,
+	}
+}
+
+// loadConfig returns the config from the defaults, the config file, the
+// environment and the flags, in increasing order of precedence
+func loadConfig(c *cli.Context) (config, error) {
+	conf := defaultConfig()
+	if filename := c.GlobalString("config"); filename != "" {
+		if err := loadConfigFile(&conf, filename); err != nil {
+			return conf, err
+		}
+	}
+	if err := conf.applyEnv(); err != nil {
+		return conf, err
+	}
+	if c.GlobalIsSet("port") {
+		conf.Listen = ":" + c.GlobalString("port")
+	}
+	if c.GlobalIsSet("db") {
+		conf.DB = c.GlobalString("db")
+	}
+	if c.GlobalIsSet("compress") {
+		conf.Compress = c.GlobalBool("compress")
+	}
+	if c.GlobalIsSet("auth") {
+		conf.Auth = c.GlobalString("auth")
+	}
+	if c.GlobalBool("debug") {
+		conf.Log.Level = "trace"
+	}
+	return conf, conf.validate()
+}
+
+// printConfig writes the config as YAML, or as TOML if format is toml
+func printConfig(w io.Writer, conf config, format string) error {
+	switch format {
+	case "yaml", "":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(conf); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case "toml":
+		return toml.NewEncoder(w).Encode(conf)
+	}
+	return fmt.Errorf("Unknown format '%s', must be yaml or toml", format)
+}
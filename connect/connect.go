@@ -5,119 +5,386 @@
 // To use, make sure that you have a boltdb-server up and running which you can do simply
 // with
 //
-// 		go get github.com/schollz/boltdb-server
-// 		$GOPATH/bin/boltdb-server
-//
+//	go get github.com/schollz/boltdb-server
+//	$GOPATH/bin/boltdb-server
 package connect
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Connection is the BoltDB server instance
 type Connection struct {
 	DBName  string
 	Address string
+
+	username string
+	password string
+	apiKey   string
+	client   *http.Client
+	tls      *tls.Config
+	headers  http.Header
+	timeout  time.Duration
+	retry    RetryPolicy
+	ctx      context.Context
+}
+
+// Option configures a Connection when it is opened
+type Option func(*Connection)
+
+// WithBasicAuth signs every request in with a username and password
+func WithBasicAuth(username, password string) Option {
+	return func(c *Connection) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithAPIKey signs every request in with an API key as a bearer token
+func WithAPIKey(key string) Option {
+	return func(c *Connection) {
+		c.apiKey = key
+	}
+}
+
+// WithHTTPClient sends requests with the client instead of http.DefaultClient
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Connection) {
+		c.client = client
+	}
+}
+
+// WithTLSConfig connects with the TLS config, like one that trusts the CA of
+// the server in RootCAs or that has a client certificate for mutual TLS. It
+// also applies to the client of WithHTTPClient, unless its transport is not
+// an *http.Transport.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Connection) {
+		c.tls = config
+	}
+}
+
+// WithHeader adds a header to every request
+func WithHeader(key, value string) Option {
+	return func(c *Connection) {
+		c.headers.Add(key, value)
+	}
+}
+
+// WithTimeout limits how long each request can take, including reading the
+// response. It does not apply to Watch, which is limited by its context.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Connection) {
+		c.timeout = timeout
+	}
 }
 
-// Open will load a connection to BoltDB
-func Open(address, dbname string) (*Connection, error) {
+// Open will load a connection to BoltDB. The address can include a base
+// path if the server is behind a proxy, like http://example.com/boltdb.
+func Open(address, dbname string, opts ...Option) (*Connection, error) {
 	c := new(Connection)
-	c.Address = address
+	c.Address = strings.TrimSuffix(address, "/")
 	c.DBName = dbname
-	resp, err := http.Get(c.Address + "/v1/uptime")
-	if err != nil {
-		return c, err
+	c.headers = make(http.Header)
+	c.ctx = context.Background()
+	for _, opt := range opts {
+		opt(c)
 	}
-	defer resp.Body.Close()
-	return c, nil
+	if c.tls != nil {
+		c.client = clientWithTLS(c.client, c.tls)
+	}
+	_, err := c.do("GET", "/v1/uptime", nil, nil)
+	return c, err
+}
+
+// clientWithTLS returns a copy of the client whose transport uses the TLS
+// config
+func clientWithTLS(client *http.Client, config *tls.Config) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return client
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = config
+	c := *client
+	c.Transport = transport
+	return &c
+}
+
+// WithContext returns a copy of the connection whose requests use ctx, so
+// they are canceled when ctx is done
+func (c *Connection) WithContext(ctx context.Context) *Connection {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c2 := new(Connection)
+	*c2 = *c
+	c2.ctx = ctx
+	return c2
 }
 
 // DeleteDatabase deletes the database
 func (c *Connection) DeleteDatabase() error {
-	req, err := http.NewRequest("DELETE", c.Address+"/v1/db/"+c.DBName, nil)
+	_, err := c.do("DELETE", "/v1/db/"+c.DBName, nil, nil)
+	return err
+}
+
+// Backup writes a consistent snapshot of the database file to w
+func (c *Connection) Backup(w io.Writer) error {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/v1/db/"+c.DBName+"/backup", nil)
 	if err != nil {
 		return err
 	}
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	return nil
-}
 
-// CreateBuckets inserts some buckets into the DB
-func (c *Connection) CreateBuckets(buckets []string) error {
-	payloadBytes, err := json.Marshal(buckets)
-	if err != nil {
-		return err
+	n, err := io.Copy(w, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
 	}
-	body := bytes.NewReader(payloadBytes)
+	return err
+}
 
-	req, err := http.NewRequest("POST", c.Address+"/v1/db/"+c.DBName+"/create", body)
+// Restore replaces the database file with the snapshot read from r, such as
+// one written by Backup
+func (c *Connection) Restore(r io.Reader) error {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	req, err := c.newRequest(ctx, "PUT", "/v1/db/"+c.DBName+"/restore", r)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", "application/octet-stream")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
 	return nil
 }
 
+// bucketPath returns the path of a bucket of the database, where the path of
+// a nested bucket like users/2024/active is escaped as a single segment
+func (c *Connection) bucketPath(bucket string) string {
+	return "/v1/db/" + c.DBName + "/bucket/" + url.PathEscape(bucket)
+}
+
+// CreateBuckets inserts some buckets into the DB, where nested buckets are
+// paths like users/2024/active and are created with their parents
+func (c *Connection) CreateBuckets(buckets []string) error {
+	_, err := c.do("POST", "/v1/db/"+c.DBName+"/create", buckets, nil)
+	return err
+}
+
 // Post keys and values to database
 func (c *Connection) Post(bucket string, keystore map[string]string) error {
-	payloadBytes, err := json.Marshal(keystore)
-	if err != nil {
-		return err
+	_, err := c.update(bucket, keystore)
+	return err
+}
+
+// PostWithTTL posts keys and values to database that expire after the ttl
+func (c *Connection) PostWithTTL(bucket string, keystore map[string]string, ttl time.Duration) error {
+	return c.PostWithTTLs(bucket, keystore, ttl, nil)
+}
+
+// PostWithTTLs posts keys and values to database, where each key expires
+// after its ttl in ttls, or after the default ttl if it does not have one.
+// A ttl of 0 means the key does not expire.
+func (c *Connection) PostWithTTLs(bucket string, keystore map[string]string, ttl time.Duration, ttls map[string]time.Duration) error {
+	type UpdateJSON struct {
+		Keystore map[string]string `json:"keystore"`
+		TTL      string            `json:"ttl,omitempty"`
+		TTLs     map[string]string `json:"ttls,omitempty"`
+	}
+	updateJSON := new(UpdateJSON)
+	updateJSON.Keystore = keystore
+	if ttl > 0 {
+		updateJSON.TTL = ttl.String()
+	}
+	updateJSON.TTLs = make(map[string]string)
+	for key, keyTTL := range ttls {
+		if keyTTL > 0 {
+			updateJSON.TTLs[key] = keyTTL.String()
+		} else {
+			updateJSON.TTLs[key] = ""
+		}
 	}
-	body := bytes.NewReader(payloadBytes)
+	_, err := c.update(bucket, updateJSON)
+	return err
+}
 
-	req, err := http.NewRequest("POST", c.Address+"/v1/db/"+c.DBName+"/bucket/"+bucket+"/update", body)
-	if err != nil {
-		return err
+// ConflictError is returned when a conditional write is not applied, with
+// the current state of the key that did not meet its condition
+type ConflictError struct {
+	Key     string `json:"key"`
+	Exists  bool   `json:"exists"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+func (e *ConflictError) Error() string {
+	return "conflicting write to '" + e.Key + "'"
+}
+
+// Is reports whether target is ErrConflict, so that errors.Is(err,
+// ErrConflict) holds for a *ConflictError
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// CompareAndSwap sets the key to newValue only if it currently has oldValue.
+// If it does not, it returns false and the current value of the key.
+func (c *Connection) CompareAndSwap(bucket string, key string, oldValue string, newValue string) (swapped bool, current string, err error) {
+	type UpdateJSON struct {
+		Keystore map[string]string `json:"keystore"`
+		IfValues map[string]string `json:"if_values"`
 	}
-	req.Header.Set("Content-Type", "application/json")
+	_, err = c.update(bucket, UpdateJSON{
+		Keystore: map[string]string{key: newValue},
+		IfValues: map[string]string{key: oldValue},
+	})
+	return checkConflict(newValue, err)
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// PutIfAbsent sets the key only if it does not exist. If it does, it returns
+// false and the current value of the key.
+func (c *Connection) PutIfAbsent(bucket string, key string, value string) (stored bool, current string, err error) {
+	type UpdateJSON struct {
+		Keystore map[string]string `json:"keystore"`
+		IfAbsent bool              `json:"if_absent"`
 	}
-	defer resp.Body.Close()
-	return nil
+	_, err = c.update(bucket, UpdateJSON{
+		Keystore: map[string]string{key: value},
+		IfAbsent: true,
+	})
+	return checkConflict(value, err)
 }
 
-// Get keys and values from database
-func (c *Connection) Get(bucket string, keys []string) (map[string]string, error) {
-	payloadBytes, err := json.Marshal(keys)
+// PutIfVersion sets the key only if it currently has the version. If it does
+// not, it returns false and the current value of the key.
+func (c *Connection) PutIfVersion(bucket string, key string, value string, version uint64) (stored bool, current string, err error) {
+	type UpdateJSON struct {
+		Keystore   map[string]string `json:"keystore"`
+		IfVersions map[string]uint64 `json:"if_versions"`
+	}
+	_, err = c.update(bucket, UpdateJSON{
+		Keystore:   map[string]string{key: value},
+		IfVersions: map[string]uint64{key: version},
+	})
+	return checkConflict(value, err)
+}
+
+// checkConflict returns whether a conditional write of value succeeded and
+// the current value of the key
+func checkConflict(value string, err error) (bool, string, error) {
+	if conflict, ok := err.(*ConflictError); ok {
+		return false, conflict.Value, nil
+	}
 	if err != nil {
-		return make(map[string]string), err
+		return false, "", err
+	}
+	return true, value, nil
+}
+
+// update posts the update payload for a bucket and returns the new versions
+// of the keys
+func (c *Connection) update(bucket string, payload interface{}) (versions map[string]uint64, err error) {
+	var target struct {
+		Versions map[string]uint64 `json:"versions"`
+	}
+	_, err = c.do("POST", c.bucketPath(bucket)+"/update", payload, &target)
+	if e, ok := err.(*Error); ok && e.Code == "conflict" {
+		// Only conditions that did not hold have the state of their key
+		conflict := new(ConflictError)
+		if json.Unmarshal(e.body, conflict) != nil || conflict.Key == "" {
+			return versions, err
+		}
+		return versions, conflict
 	}
-	body := bytes.NewReader(payloadBytes)
+	return target.Versions, err
+}
 
-	req, err := http.NewRequest("GET", c.Address+"/v1/db/"+c.DBName+"/bucket/"+bucket+"/some", body)
+// PostVersioned posts keys and values to database and returns the new
+// version of each key
+func (c *Connection) PostVersioned(bucket string, keystore map[string]string) (versions map[string]uint64, err error) {
+	return c.update(bucket, keystore)
+}
+
+// GetVersion returns the value and version of a key
+func (c *Connection) GetVersion(bucket string, key string) (value string, version uint64, err error) {
+	var target map[string]string
+	header, err := c.do("GET", c.bucketPath(bucket)+"/some?keys="+url.QueryEscape(key), nil, &target)
 	if err != nil {
-		return make(map[string]string), err
+		return value, version, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	value, ok := target[key]
+	if !ok {
+		return value, version, ErrKeyNotFound
+	}
+	etag := header.Get("ETag")
+	version, err = strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+	return value, version, err
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// PutBytes writes a value of any bytes, such as an image, with its content
+// type, or application/octet-stream if it is empty, and returns the new
+// version of the key. Unlike the other methods, the key can contain slashes.
+func (c *Connection) PutBytes(bucket string, key string, value []byte, contentType string) (version uint64, err error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	var target struct {
+		Version uint64 `json:"version"`
+	}
+	_, err = c.doRaw("PUT", c.bucketPath(bucket)+"/key/"+url.PathEscape(key), value, contentType, &target)
+	return target.Version, err
+}
+
+// GetBytes returns the bytes of a value and the content type it was written
+// with by PutBytes, or application/octet-stream
+func (c *Connection) GetBytes(bucket string, key string) (value []byte, contentType string, err error) {
+	header, err := c.doRaw("GET", c.bucketPath(bucket)+"/key/"+url.PathEscape(key), nil, "", &value)
 	if err != nil {
-		return make(map[string]string), err
+		return nil, "", err
 	}
-	defer resp.Body.Close()
+	return value, header.Get("Content-Type"), nil
+}
 
+// Versions returns the versions of the specified keys, or of every key in
+// the bucket if no keys are specified
+func (c *Connection) Versions(bucket string, keys []string) (versions map[string]uint64, err error) {
+	_, err = c.do("GET", c.bucketPath(bucket)+"/versions", keys, &versions)
+	return versions, err
+}
+
+// Get keys and values from database
+func (c *Connection) Get(bucket string, keys []string) (map[string]string, error) {
 	var target map[string]string
-	err = json.NewDecoder(resp.Body).Decode(&target)
+	_, err := c.do("GET", c.bucketPath(bucket)+"/some", keys, &target)
 	if err != nil {
 		return make(map[string]string), err
 	}
@@ -126,14 +393,8 @@ func (c *Connection) Get(bucket string, keys []string) (map[string]string, error
 
 // GetAll keys and values from database
 func (c *Connection) GetAll(bucket string) (map[string]string, error) {
-	resp, err := http.Get(c.Address + "/v1/db/" + c.DBName + "/bucket/" + bucket + "/all")
-	if err != nil {
-		return make(map[string]string), err
-	}
-	defer resp.Body.Close()
-
 	var target map[string]string
-	err = json.NewDecoder(resp.Body).Decode(&target)
+	_, err := c.do("GET", c.bucketPath(bucket)+"/all", nil, &target)
 	if err != nil {
 		return make(map[string]string), err
 	}
@@ -142,39 +403,120 @@ func (c *Connection) GetAll(bucket string) (map[string]string, error) {
 
 // GetKeys returns all keys from database
 func (c *Connection) GetKeys(bucket string) ([]string, error) {
-	resp, err := http.Get(c.Address + "/v1/db/" + c.DBName + "/bucket/" + bucket + "/keys")
+	var target []string
+	_, err := c.do("GET", c.bucketPath(bucket)+"/keys", nil, &target)
 	if err != nil {
 		return []string{}, err
 	}
-	defer resp.Body.Close()
+	return target, nil
+}
 
-	var target []string
-	err = json.NewDecoder(resp.Body).Decode(&target)
-	return target, err
+// KeyValue is a key and value returned from an ordered scan of a bucket
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
-// Pop returns and deletes the first n keys from a bucket
-func (c *Connection) Pop(bucket string, n int) (keystore map[string]string, err error) {
-	resp, err := http.Get(fmt.Sprintf("%s/v1/db/%s/bucket/%s/pop?n=%d", c.Address, c.DBName, bucket, n))
-	if err != nil {
-		return keystore, err
+// RangeOptions specifies which keys are returned by Range. Start is
+// inclusive, End is exclusive, and a Limit of 0 returns every key in the range.
+type RangeOptions struct {
+	Prefix  string
+	Start   string
+	End     string
+	Limit   int
+	Reverse bool
+}
+
+// rangePageSize is the number of keys requested from the server at a time
+const rangePageSize = 1000
+
+// Range returns the keys and values in a bucket in key order (or reverse key
+// order), fetching them from the server one page at a time.
+func (c *Connection) Range(bucket string, opts RangeOptions) (entries []KeyValue, err error) {
+	entries = []KeyValue{}
+	token := ""
+	for {
+		pageSize := rangePageSize
+		if opts.Limit > 0 && opts.Limit-len(entries) < pageSize {
+			pageSize = opts.Limit - len(entries)
+		}
+		query := url.Values{}
+		query.Set("prefix", opts.Prefix)
+		query.Set("start", opts.Start)
+		query.Set("end", opts.End)
+		query.Set("reverse", strconv.FormatBool(opts.Reverse))
+		query.Set("limit", strconv.Itoa(pageSize))
+		query.Set("token", token)
+
+		var page struct {
+			Entries []KeyValue `json:"entries"`
+			Next    string     `json:"next"`
+		}
+		_, err = c.do("GET", c.bucketPath(bucket)+"/range?"+query.Encode(), nil, &page)
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, page.Entries...)
+		token = page.Next
+		if token == "" || (opts.Limit > 0 && len(entries) >= opts.Limit) {
+			return entries, nil
+		}
 	}
-	defer resp.Body.Close()
+}
+
+// Prefix returns all the keys and values in a bucket that start with prefix, in key order
+func (c *Connection) Prefix(bucket string, prefix string) ([]KeyValue, error) {
+	return c.Range(bucket, RangeOptions{Prefix: prefix})
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&keystore)
+// Pop returns and deletes the first n keys from a bucket
+func (c *Connection) Pop(bucket string, n int) (keystore map[string]string, err error) {
+	_, err = c.do("GET", c.bucketPath(bucket)+fmt.Sprintf("/pop?n=%d", n), nil, &keystore)
 	return keystore, err
 }
 
-// HasKey checks whether a key exists, or not, in a bucket
-func (c *Connection) HasKey(bucket string, key string) (doesHaveKey bool, err error) {
-	doesHaveKey = false
-	resp, err := http.Get(fmt.Sprintf("%s/v1/db/%s/bucket/%s/haskey/%s", c.Address, c.DBName, bucket, key))
-	if err != nil {
-		return doesHaveKey, err
+// Lease holds keys popped from a bucket until they are acknowledged with
+// Ack. If they are not acknowledged before the lease expires, they are
+// returned to the bucket.
+type Lease struct {
+	ID       string            `json:"lease"`
+	Expires  time.Time         `json:"expires"`
+	Keystore map[string]string `json:"keystore"`
+}
+
+// PopLease returns the first n keys from a bucket and holds them under a
+// lease for the visibility timeout. If there are no keys in the bucket, the
+// lease has no ID and an empty keystore.
+func (c *Connection) PopLease(bucket string, n int, visibility time.Duration) (lease Lease, err error) {
+	_, err = c.do("GET", c.bucketPath(bucket)+fmt.Sprintf("/pop?n=%d&lease=%s", n, visibility), nil, &lease)
+	return lease, err
+}
+
+// Ack acknowledges keys of a lease so that they are not returned to the
+// bucket. If no keys are specified, every key of the lease is acknowledged.
+func (c *Connection) Ack(bucket string, lease string, keys ...string) error {
+	return c.releaseLease(bucket, "ack", lease, keys)
+}
+
+// Nack returns keys of a lease to the bucket immediately. If no keys are
+// specified, every key of the lease is returned.
+func (c *Connection) Nack(bucket string, lease string, keys ...string) error {
+	return c.releaseLease(bucket, "nack", lease, keys)
+}
+
+func (c *Connection) releaseLease(bucket string, action string, lease string, keys []string) error {
+	type QueryJSON struct {
+		Lease string   `json:"lease"`
+		Keys  []string `json:"keys"`
 	}
-	defer resp.Body.Close()
+	_, err := c.do("POST", c.bucketPath(bucket)+"/"+action, QueryJSON{Lease: lease, Keys: keys}, nil)
+	return err
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&doesHaveKey)
+// HasKey checks whether a key exists, or not, in a bucket
+func (c *Connection) HasKey(bucket string, key string) (doesHaveKey bool, err error) {
+	_, err = c.do("GET", c.bucketPath(bucket)+"/haskey/"+key, nil, &doesHaveKey)
 	return doesHaveKey, err
 }
 
@@ -189,25 +531,7 @@ func (c *Connection) HasKeys(buckets []string, keys []string) (doesHaveKeyMap ma
 	payloadJSON.Buckets = buckets
 	payloadJSON.Keys = keys
 
-	payloadBytes, err := json.Marshal(payloadJSON)
-	if err != nil {
-		return doesHaveKeyMap, err
-	}
-	body := bytes.NewReader(payloadBytes)
-
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/db/%s/haskeys", c.Address, c.DBName), body)
-	if err != nil {
-		return doesHaveKeyMap, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return doesHaveKeyMap, err
-	}
-	defer resp.Body.Close()
-
-	err = json.NewDecoder(resp.Body).Decode(&doesHaveKeyMap)
+	_, err = c.do("GET", fmt.Sprintf("/v1/db/%s/haskeys", c.DBName), payloadJSON, &doesHaveKeyMap)
 	return doesHaveKeyMap, err
 }
 
@@ -224,37 +548,43 @@ func (c *Connection) Move(bucket string, bucket2 string, keys []string) (err err
 	moveJSON.ToBucket = bucket2
 	moveJSON.Keys = keys
 
-	payloadBytes, err := json.Marshal(moveJSON)
-	if err != nil {
-		return err
-	}
-	body := bytes.NewReader(payloadBytes)
+	_, err = c.do("POST", fmt.Sprintf("/v1/db/%s/move", c.DBName), moveJSON, nil)
+	return err
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/db/%s/move", c.Address, c.DBName), body)
-	if err != nil {
-		return err
+// Buckets returns the names of the buckets nested in a bucket, or of the top
+// level buckets if bucket is empty
+func (c *Connection) Buckets(bucket string) (names []string, err error) {
+	path := "/v1/db/" + c.DBName + "/buckets"
+	if bucket != "" {
+		path = c.bucketPath(bucket) + "/buckets"
 	}
-	req.Header.Set("Content-Type", "application/json")
+	_, err = c.do("GET", path, nil, &names)
+	return names, err
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// BucketTree is a bucket with the number of keys in it and the buckets
+// nested in it
+type BucketTree struct {
+	Name    string       `json:"name"`
+	Path    string       `json:"path"` // path of the bucket, like users/2024/active
+	Keys    int          `json:"keys"`
+	Buckets []BucketTree `json:"buckets"`
+}
+
+// Tree returns the tree of the buckets nested in a bucket, or of every
+// bucket if bucket is empty
+func (c *Connection) Tree(bucket string) (tree BucketTree, err error) {
+	path := "/v1/db/" + c.DBName + "/tree"
+	if bucket != "" {
+		path = c.bucketPath(bucket) + "/tree"
 	}
-	defer resp.Body.Close()
-	return nil
+	_, err = c.do("GET", path, nil, &tree)
+	return tree, err
 }
 
 // Stats returns a list of buckets and number of keys in each
 func (c *Connection) Stats() (stats map[string]int, err error) {
-	resp, err := http.Get(fmt.Sprintf("%s/v1/db/%s/stats", c.Address, c.DBName))
-	if err != nil {
-		return stats, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		err = json.NewDecoder(resp.Body).Decode(&stats)
-	} else {
-		err = errors.New("Problem getting stats")
-	}
+	_, err = c.do("GET", fmt.Sprintf("/v1/db/%s/stats", c.DBName), nil, &stats)
 	return stats, err
 }
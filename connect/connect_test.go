@@ -1,19 +1,42 @@
 package connect
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/schollz/boltdb-server/connect/connecttest"
 )
 
-// Start server with
-// go build; .\boltdb-server.exe
-var testingServer = "http://localhost:8050"
+// testingServer is a server started in the process for the tests, with its
+// databases in testingDBPath
+var testingServer, testingDBPath string
+
+func TestMain(m *testing.M) {
+	ts := connecttest.NewServer()
+	testingServer, testingDBPath = ts.URL, ts.DBPath
+	code := m.Run()
+	ts.Close()
+	os.Exit(code)
+}
 
 func BenchmarkPost1(b *testing.B) {
-	os.Remove(path.Join("..", "dbs", "testbench.db"))
+	os.Remove(path.Join(testingDBPath, "testbench.db"))
 	conn, _ := Open(testingServer, "testbench")
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -127,7 +150,7 @@ func TestGeneral(t *testing.T) {
 	if err != nil {
 		t.Errorf(err.Error())
 	}
-	if _, err := os.Stat(path.Join("..", "dbs", "testdb.db")); os.IsNotExist(err) {
+	if _, err := os.Stat(path.Join(testingDBPath, "testdb.db")); os.IsNotExist(err) {
 		t.Errorf("Problem creating directory")
 	}
 
@@ -242,7 +265,1066 @@ func TestGeneral(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if _, err := os.Stat(path.Join("..", "dbs", "testdb.db")); os.IsExist(err) {
+	if _, err := os.Stat(path.Join(testingDBPath, "testdb.db")); os.IsExist(err) {
 		t.Errorf("Problem deleting db")
 	}
 }
+
+func TestRange(t *testing.T) {
+	conn, err := Open(testingServer, "testrange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	data := make(map[string]string)
+	for i := 0; i < 2500; i++ {
+		data[fmt.Sprintf("key%04d", i)] = "value" + strconv.Itoa(i)
+	}
+	data["other"] = "thing"
+	err = conn.Post("ranged", data)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Test paging through a whole prefix
+	entries, err := conn.Prefix("ranged", "key")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 2500 {
+		t.Errorf("Problem getting prefix, got %d entries", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Key != fmt.Sprintf("key%04d", i) || entry.Value != "value"+strconv.Itoa(i) {
+			t.Errorf("Problem with order of prefix: %v", entry)
+			break
+		}
+	}
+
+	// Test start, end and limit
+	entries, err = conn.Range("ranged", RangeOptions{Start: "key0010", End: "key0020", Limit: 5})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 5 || entries[0].Key != "key0010" || entries[4].Key != "key0014" {
+		t.Errorf("Problem with range: %v", entries)
+	}
+
+	// Test reverse
+	entries, err = conn.Range("ranged", RangeOptions{Prefix: "key", End: "key0020", Reverse: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 20 || entries[0].Key != "key0019" || entries[19].Key != "key0000" {
+		t.Errorf("Problem with reverse range: %v", entries)
+	}
+	entries, err = conn.Range("ranged", RangeOptions{Reverse: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 2501 || entries[0].Key != "other" || entries[2500].Key != "key0000" {
+		t.Errorf("Problem with reverse range over bucket, got %d entries", len(entries))
+	}
+
+	// Test range of bucket that doesn't exist
+	_, err = conn.Prefix("asldkfjaslkdjf", "key")
+	if err == nil {
+		t.Errorf("Should throw error, bucket does not exist")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	conn, err := Open(testingServer, "testttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	err = conn.PostWithTTLs("cache", map[string]string{"short": "1", "long": "2", "forever": "3"}, 1*time.Hour, map[string]time.Duration{"short": 1 * time.Second, "forever": 0})
+	if err != nil {
+		t.Error(err)
+	}
+	hasKey, err := conn.HasKey("cache", "short")
+	if err != nil {
+		t.Error(err)
+	}
+	if !hasKey {
+		t.Errorf("Key should not have expired yet")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	hasKey, err = conn.HasKey("cache", "short")
+	if err != nil {
+		t.Error(err)
+	}
+	if hasKey {
+		t.Errorf("Key should have expired")
+	}
+	data, err := conn.GetAll("cache")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(data) != 2 || data["long"] != "2" || data["forever"] != "3" {
+		t.Errorf("Problem hiding expired keys: %v", data)
+	}
+	keys, err := conn.GetKeys("cache")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Problem hiding expired keys: %v", keys)
+	}
+
+	// Posting without a TTL clears the old one
+	err = conn.PostWithTTL("cache", map[string]string{"again": "4"}, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.Post("cache", map[string]string{"again": "5"})
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	keystore, err := conn.Pop("cache", 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keystore) != 3 || keystore["again"] != "5" {
+		t.Errorf("Problem popping keys with TTLs: %v", keystore)
+	}
+}
+
+func TestTx(t *testing.T) {
+	conn, err := Open(testingServer, "testtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	err = conn.Post("accounts", map[string]string{"zack": "open", "jessie": "open"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = conn.Tx().
+		IfValue("accounts", "zack", "open").
+		IfNotExists("closed", "zack").
+		Put("accounts", map[string]string{"zack": "closed"}).
+		Move("accounts", "closed", []string{"zack"}).
+		CreateBucket("audit").
+		Put("audit", map[string]string{"1": "closed zack"}).
+		Commit()
+	if err != nil {
+		t.Error(err)
+	}
+	data, err := conn.GetAll("closed")
+	if err != nil {
+		t.Error(err)
+	}
+	if data["zack"] != "closed" {
+		t.Errorf("Problem applying transaction: %v", data)
+	}
+
+	// Test failed precondition
+	err = conn.Tx().
+		IfExists("accounts", "zack").
+		Delete("accounts", []string{"jessie"}).
+		Commit()
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Precondition should fail: %v", err)
+	}
+
+	// Test rollback when a later op fails
+	err = conn.Tx().
+		Delete("accounts", []string{"jessie"}).
+		DeleteBucket("asldkfjaslkdjf").
+		Commit()
+	if err == nil {
+		t.Errorf("Should throw error, bucket does not exist")
+	}
+	hasKey, err := conn.HasKey("accounts", "jessie")
+	if err != nil {
+		t.Error(err)
+	}
+	if !hasKey {
+		t.Errorf("Problem rolling back transaction")
+	}
+
+	// Keys put without a positive ttl don't expire
+	err = conn.Tx().
+		PutWithTTL("sessions", map[string]string{"zack": "1"}, time.Hour).
+		PutWithTTL("sessions", map[string]string{"jessie": "2"}, 0).
+		Commit()
+	if err != nil {
+		t.Errorf("Problem putting with ttls: %v", err)
+	}
+	data, err = conn.GetAll("sessions")
+	if err != nil || data["zack"] != "1" || data["jessie"] != "2" {
+		t.Errorf("Problem putting with ttls: %v %v", data, err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	conn, err := Open(testingServer, "testcas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	stored, current, err := conn.PutIfAbsent("counters", "zack", "1")
+	if err != nil {
+		t.Error(err)
+	}
+	if !stored || current != "1" {
+		t.Errorf("Problem putting absent key")
+	}
+	stored, current, err = conn.PutIfAbsent("counters", "zack", "100")
+	if err != nil {
+		t.Error(err)
+	}
+	if stored || current != "1" {
+		t.Errorf("Should not put key that exists, got current value %s", current)
+	}
+
+	swapped, current, err := conn.CompareAndSwap("counters", "zack", "1", "2")
+	if err != nil {
+		t.Error(err)
+	}
+	if !swapped || current != "2" {
+		t.Errorf("Problem swapping value")
+	}
+	swapped, current, err = conn.CompareAndSwap("counters", "zack", "1", "3")
+	if err != nil {
+		t.Error(err)
+	}
+	if swapped || current != "2" {
+		t.Errorf("Should not swap old value, got current value %s", current)
+	}
+	swapped, _, err = conn.CompareAndSwap("counters", "jessie", "1", "3")
+	if err != nil {
+		t.Error(err)
+	}
+	if swapped {
+		t.Errorf("Should not swap key that does not exist")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	conn, err := Open(testingServer, "testversions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	versions, err := conn.PostVersioned("docs", map[string]string{"a": "1", "b": "2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(versions) != 2 || versions["a"] == versions["b"] {
+		t.Errorf("Problem getting versions: %v", versions)
+	}
+
+	value, version, err := conn.GetVersion("docs", "a")
+	if err != nil {
+		t.Error(err)
+	}
+	if value != "1" || version != versions["a"] {
+		t.Errorf("Problem getting version of key: %s %d", value, version)
+	}
+
+	stored, _, err := conn.PutIfVersion("docs", "a", "3", version)
+	if err != nil {
+		t.Error(err)
+	}
+	if !stored {
+		t.Errorf("Should put key with matching version")
+	}
+	stored, current, err := conn.PutIfVersion("docs", "a", "4", version)
+	if err != nil {
+		t.Error(err)
+	}
+	if stored || current != "3" {
+		t.Errorf("Should not put key with old version")
+	}
+
+	versions2, err := conn.Versions("docs", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if versions2["a"] <= versions["b"] || versions2["b"] != versions["b"] {
+		t.Errorf("Versions should increase: %v %v", versions, versions2)
+	}
+
+	err = conn.Tx().IfVersion("docs", "b", versions["b"]).Delete("docs", []string{"b"}).Commit()
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.Tx().IfVersion("docs", "a", version).Delete("docs", []string{"a"}).Commit()
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Precondition should fail: %v", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	conn, err := Open(testingServer, "testlease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	err = conn.Post("queue", map[string]string{"1": "a", "2": "b", "3": "c"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	lease, err := conn.PopLease("queue", 2, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+	if lease.ID == "" || len(lease.Keystore) != 2 || lease.Keystore["1"] != "a" {
+		t.Errorf("Problem popping with lease: %v", lease)
+	}
+	keys, _ := conn.GetKeys("queue")
+	if len(keys) != 1 {
+		t.Errorf("Leased keys should not be in bucket: %v", keys)
+	}
+
+	// Acknowledge one key and let the other be redelivered
+	err = conn.Ack("queue", lease.ID, "1")
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	lease2, err := conn.PopLease("queue", 10, 1*time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(lease2.Keystore) != 2 || lease2.Keystore["2"] != "b" || lease2.Keystore["3"] != "c" {
+		t.Errorf("Problem redelivering expired lease: %v", lease2)
+	}
+	err = conn.Ack("queue", lease.ID)
+	if err == nil {
+		t.Errorf("Should not acknowledge expired lease")
+	}
+
+	// Nack returns keys immediately
+	err = conn.Nack("queue", lease2.ID, "3")
+	if err != nil {
+		t.Error(err)
+	}
+	keys, _ = conn.GetKeys("queue")
+	if len(keys) != 1 || keys[0] != "3" {
+		t.Errorf("Problem returning key with nack: %v", keys)
+	}
+	err = conn.Ack("queue", lease2.ID)
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.Ack("queue", lease2.ID)
+	if err == nil {
+		t.Errorf("Should not acknowledge lease twice")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	conn, err := Open(testingServer, "testwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := conn.WatchPrefix(ctx, "people", "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Post("people", map[string]string{"zack": "canada", "jessie": "usa"})
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.Post("other", map[string]string{"zeke": "mexico"})
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.Move("people", "people2", []string{"zack"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := []Event{
+		{Type: "put", Bucket: "people", Key: "zack", Value: "canada"},
+		{Type: "move", Bucket: "people", Key: "zack", ToBucket: "people2"},
+	}
+	for _, want := range expected {
+		select {
+		case e := <-events:
+			if e.Type != want.Type || e.Bucket != want.Bucket || e.Key != want.Key || e.Value != want.Value || e.ToBucket != want.ToBucket {
+				t.Errorf("Got event %v, expected %v", e, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %v", want)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	conn, err := Open(testingServer, "testbackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	err = conn.Post("people_locations", map[string]string{"zack": "canada"})
+	if err != nil {
+		t.Error(err)
+	}
+	var snapshot bytes.Buffer
+	err = conn.Backup(&snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = conn.Post("people_locations", map[string]string{"zack": "usa", "jessie": "usa"})
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.Restore(&snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+	data, err := conn.GetAll("people_locations")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(data) != 1 || data["zack"] != "canada" {
+		t.Errorf("Problem restoring backup: %v", data)
+	}
+
+	// Test restoring something that isn't a database
+	err = conn.Restore(strings.NewReader("not a database"))
+	if err == nil {
+		t.Errorf("Should not restore invalid snapshot")
+	}
+	data, err = conn.GetAll("people_locations")
+	if err != nil || data["zack"] != "canada" {
+		t.Errorf("Failed restore should not change database: %v", data)
+	}
+
+	// Test backing up database that doesn't exist
+	conn2, _ := Open(testingServer, "asldkfjaslkdjf")
+	err = conn2.Backup(&snapshot)
+	if err == nil {
+		t.Errorf("Should throw error, database does not exist")
+	}
+}
+
+func TestAuthOptions(t *testing.T) {
+	var mu sync.Mutex
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorization = r.Header.Get("Authorization")
+		mu.Unlock()
+		fmt.Fprint(w, "{}")
+	}))
+	defer ts.Close()
+	sent := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return authorization
+	}
+
+	conn, err := Open(ts.URL, "testauth", WithBasicAuth("zack", "123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Stats(); err != nil {
+		t.Error(err)
+	}
+	if auth := sent(); auth != "Basic emFjazoxMjM=" {
+		t.Errorf("Did not send basic auth: '%s'", auth)
+	}
+
+	conn, err = Open(ts.URL, "testauth", WithAPIKey("k3y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Stats(); err != nil {
+		t.Error(err)
+	}
+	if auth := sent(); auth != "Bearer k3y" {
+		t.Errorf("Did not send API key: '%s'", auth)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	for _, dbname := range []string{"..", ".hidden", "a b", "__internal"} {
+		conn, _ := Open(testingServer, dbname)
+		err := conn.Post("people_locations", map[string]string{"zack": "canada"})
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Should not post to database '%s': %v", dbname, err)
+		}
+	}
+
+	conn, _ := Open(testingServer, "testnames")
+	defer conn.DeleteDatabase()
+	err := conn.Post("__meta", map[string]string{"zack": "canada"})
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Should not post to reserved bucket: %v", err)
+	}
+	err = conn.Tx().Put("__leases", map[string]string{"zack": "canada"}).Commit()
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Should not write reserved bucket in transaction: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	conn, err := Open(testingServer, "testerrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+	err = conn.Post("people_locations", map[string]string{"zack": "canada"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = conn.GetAll("asldkfjaslkdjf"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("GetAll of missing bucket should be ErrBucketNotFound: %v", err)
+	}
+	if _, err = conn.GetKeys("asldkfjaslkdjf"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("GetKeys of missing bucket should be ErrBucketNotFound: %v", err)
+	}
+	if _, err = conn.Pop("asldkfjaslkdjf", 1); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Pop of missing bucket should be ErrBucketNotFound: %v", err)
+	}
+	if err = conn.Move("people_locations", "other", []string{"jessie"}); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Move of missing key should be ErrKeyNotFound: %v", err)
+	}
+	if _, _, err = conn.GetVersion("people_locations", "jessie"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetVersion of missing key should be ErrKeyNotFound: %v", err)
+	}
+	if err = conn.Ack("people_locations", "asldkfjaslkdjf"); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("Ack of missing lease should be ErrLeaseNotFound: %v", err)
+	}
+	if _, err = conn.Pop("people_locations", 0); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Pop of 0 keys should be ErrBadRequest: %v", err)
+	}
+	_, err = conn.PostVersioned("people_locations", nil)
+	if !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Post without keystore should be ErrBadRequest: %v", err)
+	}
+
+	conn2, _ := Open(testingServer, "asldkfjaslkdjf")
+	if _, err = conn2.GetAll("people_locations"); !errors.Is(err, ErrDBNotFound) {
+		t.Errorf("GetAll of missing database should be ErrDBNotFound: %v", err)
+	}
+	if err = conn2.DeleteDatabase(); !errors.Is(err, ErrDBNotFound) {
+		t.Errorf("Deleting missing database should be ErrDBNotFound: %v", err)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	var mu sync.Mutex
+	var status int
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/uptime" {
+			fmt.Fprint(w, `{"uptime":"1s"}`)
+			return
+		}
+		mu.Lock()
+		st, b := status, body
+		mu.Unlock()
+		w.WriteHeader(st)
+		fmt.Fprint(w, b)
+	}))
+	defer ts.Close()
+	respond := func(st int, b string) {
+		mu.Lock()
+		status, body = st, b
+		mu.Unlock()
+	}
+	conn, err := Open(ts.URL, "testrequesterrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes that used to ignore the status
+	respond(http.StatusInternalServerError, `{"code":"internal","message":"disk is full"}`)
+	writes := map[string]func() error{
+		"Post":           func() error { return conn.Post("bucket", map[string]string{"a": "b"}) },
+		"CreateBuckets":  func() error { return conn.CreateBuckets([]string{"bucket"}) },
+		"DeleteDatabase": conn.DeleteDatabase,
+		"Move":           func() error { return conn.Move("bucket", "bucket2", []string{"a"}) },
+	}
+	for name, write := range writes {
+		err = write()
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s should return *Error: %v", name, err)
+			continue
+		}
+		if e.StatusCode != 500 || e.Code != "internal" || e.Message != "disk is full" {
+			t.Errorf("%s returned wrong error: %+v", name, e)
+		}
+	}
+
+	// Known codes match the Err values
+	respond(http.StatusNotFound, `{"code":"bucket_not_found","message":"Bucket 'bucket' does not exist"}`)
+	_, err = conn.GetAll("bucket")
+	if !errors.Is(err, ErrBucketNotFound) || errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Should be ErrBucketNotFound: %v", err)
+	}
+	if err.Error() != "404 bucket_not_found: Bucket 'bucket' does not exist" {
+		t.Errorf("Wrong message: %s", err.Error())
+	}
+
+	// Bodies that aren't JSON, like from a proxy
+	respond(http.StatusBadGateway, "upstream went away\n")
+	_, err = conn.Stats()
+	if e, ok := err.(*Error); !ok || e.StatusCode != 502 || e.Code != "" || e.Message != "upstream went away" {
+		t.Errorf("Wrong error for plain text body: %v", err)
+	}
+	respond(http.StatusServiceUnavailable, "")
+	_, err = conn.GetKeys("bucket")
+	if err == nil || err.Error() != "503 Service Unavailable" {
+		t.Errorf("Wrong error for empty body: %v", err)
+	}
+
+	// Conflicts keep the current state of the key
+	respond(http.StatusConflict, `{"code":"conflict","message":"Conflicting write to 'a'","key":"a","exists":true,"value":"c","version":3}`)
+	swapped, current, err := conn.CompareAndSwap("bucket", "a", "b", "d")
+	if err != nil || swapped || current != "c" {
+		t.Errorf("Problem with conflict: %v %v %v", swapped, current, err)
+	}
+	_, err = conn.PostVersioned("bucket", map[string]string{"a": "d"})
+	if conflict, ok := err.(*ConflictError); !ok || conflict.Version != 3 || !errors.Is(err, ErrConflict) {
+		t.Errorf("Should be *ConflictError: %v", err)
+	}
+
+	// Successful responses that can't be decoded
+	respond(http.StatusOK, "not json")
+	_, err = conn.Get("bucket", []string{"a"})
+	if err == nil {
+		t.Errorf("Should not decode invalid response")
+	}
+
+	// Streams check the status before reading
+	respond(http.StatusForbidden, `{"code":"forbidden","message":"Requires admin access"}`)
+	var snapshot bytes.Buffer
+	if err = conn.Backup(&snapshot); !errors.Is(err, ErrForbidden) || snapshot.Len() != 0 {
+		t.Errorf("Backup should be ErrForbidden: %v", err)
+	}
+	if _, err = conn.Watch(context.Background(), ""); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Watch should be ErrForbidden: %v", err)
+	}
+	respond(http.StatusPreconditionFailed, `{"code":"precondition_failed","message":"Precondition failed"}`)
+	if err = conn.Tx().Delete("bucket", []string{"a"}).Commit(); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Commit should be ErrPreconditionFailed: %v", err)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	// The handler runs in the goroutines of the server
+	var mu sync.Mutex
+	var requests int
+	var header, path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		header = r.Header.Get("X-Request-Source")
+		path = r.URL.Path
+		mu.Unlock()
+		if r.URL.Query().Get("n") == "slow" {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+			}
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: http.DefaultTransport}
+	conn, err := Open(ts.URL+"/boltdb/", "testoptions",
+		WithHTTPClient(client),
+		WithHeader("X-Request-Source", "tests"),
+		WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Stats(); err != nil {
+		t.Error(err)
+	}
+	mu.Lock()
+	if header != "tests" || path != "/boltdb/v1/db/testoptions/stats" {
+		t.Errorf("Problem with header or base path: '%s' %s", header, path)
+	}
+	mu.Unlock()
+
+	// Requests time out
+	start := time.Now()
+	_, err = conn.do("GET", "/v1/db/testoptions/stats?n=slow", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("Request should time out: %v", err)
+	}
+
+	// Requests are canceled with their context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mu.Lock()
+	requests = 0
+	mu.Unlock()
+	_, err = conn.WithContext(ctx).Stats()
+	mu.Lock()
+	if !errors.Is(err, context.Canceled) || requests != 0 {
+		t.Errorf("Request should be canceled: %v", err)
+	}
+	mu.Unlock()
+	if _, err = conn.Stats(); err != nil {
+		t.Errorf("WithContext should not change the connection: %v", err)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	conn, err := Open(testingServer, "testbytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	png := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0xff, 0xfe}
+	version, err := conn.PutBytes("images", "logos/small.png", png, "image/png")
+	if err != nil || version == 0 {
+		t.Fatalf("Problem putting bytes: %d %v", version, err)
+	}
+	value, contentType, err := conn.GetBytes("images", "logos/small.png")
+	if err != nil || !bytes.Equal(value, png) || contentType != "image/png" {
+		t.Errorf("Problem getting bytes: %v %s %v", value, contentType, err)
+	}
+
+	// Values written as JSON are returned as they are stored
+	if err = conn.Post("images", map[string]string{"name": "logo"}); err != nil {
+		t.Fatal(err)
+	}
+	value, contentType, err = conn.GetBytes("images", "name")
+	if err != nil || string(value) != "logo" || contentType != "application/octet-stream" {
+		t.Errorf("Problem getting bytes of JSON value: %q %s %v", value, contentType, err)
+	}
+
+	if _, _, err = conn.GetBytes("images", "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Missing key should be not found: %v", err)
+	}
+}
+
+func TestNestedBuckets(t *testing.T) {
+	conn, err := Open(testingServer, "testnested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	if err = conn.Post("users/2024/active", map[string]string{"ann": "1", "bob": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Post("users", map[string]string{"count": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := conn.GetAll("users/2024/active")
+	if err != nil || len(m) != 2 || m["ann"] != "1" {
+		t.Errorf("Problem getting nested bucket: %v %v", m, err)
+	}
+
+	names, err := conn.Buckets("")
+	if err != nil || len(names) != 1 || names[0] != "users" {
+		t.Errorf("Problem getting top level buckets: %v %v", names, err)
+	}
+	names, err = conn.Buckets("users/2024")
+	if err != nil || len(names) != 1 || names[0] != "active" {
+		t.Errorf("Problem getting child buckets: %v %v", names, err)
+	}
+
+	tree, err := conn.Tree("users")
+	if err != nil || tree.Keys != 1 || len(tree.Buckets) != 1 || tree.Buckets[0].Path != "users/2024" || tree.Buckets[0].Buckets[0].Keys != 2 {
+		t.Errorf("Problem getting tree: %+v %v", tree, err)
+	}
+	if _, err = conn.Tree("users/2025"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Missing nested bucket should not be found: %v", err)
+	}
+
+	// Writing a key where there is a bucket fails instead of losing a race
+	if stored, _, err := conn.PutIfAbsent("users", "2024", "x"); stored || !errors.Is(err, ErrIncompatibleValue) || errors.Is(err, ErrConflict) {
+		t.Errorf("Key over a bucket should be ErrIncompatibleValue: %v %v", stored, err)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	conn, err := Open(testingServer, "testiterate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+
+	keystore := make(map[string]string)
+	for i := 0; i < 2500; i++ {
+		keystore[fmt.Sprintf("key%04d", i)] = strconv.Itoa(i)
+	}
+	if err = conn.Post("numbers", keystore); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := conn.Iterate(context.Background(), "numbers", RangeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for it.Next() {
+		if e := it.Entry(); e.Key != fmt.Sprintf("key%04d", n) || e.Value != strconv.Itoa(n) {
+			t.Fatalf("Problem iterating at %d: %+v", n, e)
+		}
+		n++
+	}
+	if err = it.Err(); err != nil || n != 2500 {
+		t.Errorf("Problem iterating: %d %v", n, err)
+	}
+	it.Close()
+
+	it, err = conn.Iterate(context.Background(), "numbers", RangeOptions{Prefix: "key1", Reverse: true, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Entry().Key)
+	}
+	it.Close()
+	if it.Err() != nil || strings.Join(keys, ",") != "key1999,key1998,key1997" {
+		t.Errorf("Problem iterating range: %v %v", keys, it.Err())
+	}
+
+	if _, err = conn.Iterate(context.Background(), "missing", RangeOptions{}); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Missing bucket should not be found: %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	// The state and handler are used by the goroutines of the server
+	var mu sync.Mutex
+	var requests int
+	var failures int
+	var keys []string
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		fail := requests <= failures
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "Service Unavailable")
+			return
+		}
+		fmt.Fprint(w, `{"zack":"canada"}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := handler
+		mu.Unlock()
+		h(w, r)
+	}))
+	defer ts.Close()
+	reset := func(f int, h http.HandlerFunc) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests, failures, keys = 0, f, nil
+		if h != nil {
+			handler = h
+		}
+	}
+	check := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+
+	conn, err := Open(ts.URL, "testretry", WithRetry(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests are retried with the same Idempotency-Key
+	reset(2, nil)
+	keystore, err := conn.Pop("people_locations", 1)
+	if err != nil || keystore["zack"] != "canada" {
+		t.Errorf("Pop should succeed after retries: %v %v", keystore, err)
+	}
+	check(func() {
+		if requests != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] {
+			t.Errorf("Problem with retries: %d requests with keys %v", requests, keys)
+		}
+	})
+
+	// The last error is returned when attempts run out
+	reset(5, nil)
+	_, err = conn.Pop("people_locations", 1)
+	var e *Error
+	check(func() {
+		if !errors.As(err, &e) || e.StatusCode != http.StatusServiceUnavailable || requests != 3 {
+			t.Errorf("Pop should fail after 3 attempts: %d %v", requests, err)
+		}
+	})
+
+	// Errors from the server are not retried
+	reset(0, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"code":"bucket_not_found","message":"Bucket 'people_locations' does not exist"}`)
+	})
+	_, err = conn.Pop("people_locations", 1)
+	check(func() {
+		if !errors.Is(err, ErrBucketNotFound) || requests != 1 {
+			t.Errorf("Pop of missing bucket should not be retried: %d %v", requests, err)
+		}
+	})
+
+	// Dropped connections are retried
+	reset(0, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		c, _, _ := w.(http.Hijacker).Hijack()
+		c.Close()
+	})
+	_, err = conn.Pop("people_locations", 1)
+	check(func() {
+		if err == nil || requests < 3 {
+			t.Errorf("Pop should be retried after dropped connections: %d %v", requests, err)
+		}
+	})
+
+	// Untrusted certificates are not
+	var conns int
+	tlsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsServer.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	tlsServer.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	_, err = Open(tlsServer.URL, "testretry", WithRetry(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}))
+	check(func() {
+		if err == nil || conns != 1 {
+			t.Errorf("Untrusted certificate should not be retried: %d %v", conns, err)
+		}
+	})
+
+	// Connections without a policy don't retry or send keys
+	conn, _ = Open(ts.URL, "testretry")
+	reset(0, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	_, err = conn.Pop("people_locations", 1)
+	check(func() {
+		if err == nil || requests != 1 || keys[0] != "" {
+			t.Errorf("Pop should not be retried without a policy: %d %v %v", requests, keys, err)
+		}
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	conn, err := Open(testingServer, "testidempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteDatabase()
+	err = conn.Post("queue", map[string]string{"1": "a", "2": "b", "3": "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := strconv.FormatInt(time.Now().UnixNano(), 10)
+	pop := func(n int) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/v1/db/testidempotency/bucket/queue/pop?n=%d", testingServer, n), nil)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return resp, body.String()
+	}
+
+	// A retried pop returns the same keys without popping more
+	resp1, body1 := pop(1)
+	resp2, body2 := pop(1)
+	if resp1.StatusCode != http.StatusOK || resp2.StatusCode != http.StatusOK || body1 != body2 {
+		t.Errorf("Retried pop should return the same keys: %s %s", body1, body2)
+	}
+	if resp2.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Retried pop should be replayed")
+	}
+	keys, err := conn.GetKeys("queue")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Only one key should be popped: %v %v", keys, err)
+	}
+
+	// A key can't be used for a different request
+	resp3, _ := pop(2)
+	if resp3.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Reused key should be rejected, got %d", resp3.StatusCode)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ts := connecttest.NewTLSServer()
+	defer ts.Close()
+	if !strings.HasPrefix(ts.URL, "https://") {
+		t.Fatalf("Server should use https: %s", ts.URL)
+	}
+
+	// The certificate of the server is not trusted by default
+	if _, err := Open(ts.URL, "testtls"); err == nil {
+		t.Errorf("Open should fail without the CA of the server")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	conn, err := Open(ts.URL, "testtls", WithTLSConfig(&tls.Config{RootCAs: roots}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Post("food", map[string]string{"apple": "red"}); err != nil {
+		t.Error(err)
+	}
+
+	// The TLS config also applies to the client of WithHTTPClient
+	conn, err = Open(ts.URL, "testtls",
+		WithHTTPClient(&http.Client{Timeout: time.Second}),
+		WithTLSConfig(&tls.Config{RootCAs: roots}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keystore, err := conn.GetAll("food"); err != nil || keystore["apple"] != "red" {
+		t.Errorf("Problem getting over TLS: %v %v", keystore, err)
+	}
+}
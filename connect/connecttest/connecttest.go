@@ -0,0 +1,83 @@
+// Package connecttest runs a boltdb-server inside the process, so that tests
+// of the connect package and of programs that use it don't need a server to
+// be started first.
+//
+//	ts := connecttest.NewServer()
+//	defer ts.Close()
+//	conn, err := connect.Open(ts.URL, "testdb")
+package connecttest
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+
+	"github.com/schollz/boltdb-server/server"
+)
+
+// Server is a boltdb-server listening on a local port
+type Server struct {
+	*httptest.Server
+	DBPath string // directory of the databases
+
+	server  *server.Server
+	tempDir bool
+}
+
+// NewServer starts a server without auth, with its databases in a temporary
+// directory that is removed when it is closed. It panics if the server can't
+// be started, like httptest.NewServer.
+func NewServer() *Server {
+	return NewServerWithConfig(server.Config{})
+}
+
+// NewTLSServer starts a server without auth that serves https, like
+// httptest.NewTLSServer. Connections need WithTLSConfig with the CA of
+// s.Certificate(), or the client of s.Client().
+func NewTLSServer() *Server {
+	s := newServer(server.Config{})
+	s.StartTLS()
+	return s
+}
+
+// NewServerWithConfig starts a server with the config, keeping its databases
+// in a temporary directory unless config.DBPath is set
+func NewServerWithConfig(config server.Config) *Server {
+	s := newServer(config)
+	s.Start()
+	return s
+}
+
+// newServer returns a server that has not been started
+func newServer(config server.Config) *Server {
+	s := &Server{DBPath: config.DBPath}
+	if s.DBPath == "" {
+		dir, err := ioutil.TempDir("", "boltdb-server-")
+		if err != nil {
+			panic("connecttest: " + err.Error())
+		}
+		s.DBPath, s.tempDir = dir, true
+		config.DBPath = dir
+	}
+	var err error
+	s.server, err = server.New(config)
+	if err != nil {
+		s.removeTempDir()
+		panic("connecttest: " + err.Error())
+	}
+	s.Server = httptest.NewUnstartedServer(s.server)
+	return s
+}
+
+// Close shuts down the server and removes its temporary directory
+func (s *Server) Close() {
+	s.server.Close()
+	s.Server.Close()
+	s.removeTempDir()
+}
+
+func (s *Server) removeTempDir() {
+	if s.tempDir {
+		os.RemoveAll(s.DBPath)
+	}
+}
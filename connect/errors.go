@@ -0,0 +1,105 @@
+package connect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Errors returned by the server, which can be checked with errors.Is against
+// the errors returned by a Connection
+var (
+	ErrBadRequest         = errors.New("bad request")
+	ErrInvalidName        = errors.New("invalid database or bucket name")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrDBNotFound         = errors.New("database not found")
+	ErrBucketNotFound     = errors.New("bucket not found")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrLeaseNotFound      = errors.New("lease not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrIdempotencyKeyReused is returned if the Idempotency-Key of a retry
+	// was already used for a different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused")
+
+	// ErrRequestTooLarge is returned if the body of a request is larger than
+	// the server allows
+	ErrRequestTooLarge = errors.New("request too large")
+
+	// ErrShuttingDown is returned by a server that is shutting down, which
+	// WithRetry retries like any other 503
+	ErrShuttingDown = errors.New("server is shutting down")
+
+	// ErrCorruptValue is returned if a stored value can't be decompressed
+	ErrCorruptValue = errors.New("corrupt value")
+
+	// ErrIncompatibleValue is returned for writing a key where there is a
+	// nested bucket, or a bucket where there is a key
+	ErrIncompatibleValue = errors.New("incompatible value")
+)
+
+// errorCodes are the errors for the codes returned by the server
+var errorCodes = map[string]error{
+	"bad_request":         ErrBadRequest,
+	"invalid_name":        ErrInvalidName,
+	"unauthorized":        ErrUnauthorized,
+	"forbidden":           ErrForbidden,
+	"db_not_found":        ErrDBNotFound,
+	"bucket_not_found":    ErrBucketNotFound,
+	"key_not_found":       ErrKeyNotFound,
+	"lease_not_found":     ErrLeaseNotFound,
+	"conflict":            ErrConflict,
+	"precondition_failed": ErrPreconditionFailed,
+
+	"idempotency_key_reused": ErrIdempotencyKeyReused,
+	"request_too_large":      ErrRequestTooLarge,
+	"shutting_down":          ErrShuttingDown,
+	"corrupt_value":          ErrCorruptValue,
+	"incompatible_value":     ErrIncompatibleValue,
+}
+
+// Error is an error response from the server. Its code can be checked with
+// errors.Is against the Err values, such as errors.Is(err, ErrBucketNotFound).
+type Error struct {
+	StatusCode int    // HTTP status of the response
+	Code       string // code of the error, or empty if the server did not send one
+	Message    string // message of the error
+
+	body []byte
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Unwrap returns the Err value of the code of the error, if there is one
+func (e *Error) Unwrap() error {
+	return errorCodes[e.Code]
+}
+
+// errorFromResponse returns the *Error of a response that is not 200 OK
+func errorFromResponse(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	e.body, _ = ioutil.ReadAll(resp.Body)
+	var target struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(e.body, &target) == nil && target.Code != "" {
+		e.Code = target.Code
+		e.Message = target.Message
+	} else if message := strings.TrimSpace(string(e.body)); message != "" {
+		e.Message = message
+	} else {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
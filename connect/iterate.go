@@ -0,0 +1,117 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Iterator reads the keys and values of a range of a bucket as the server
+// streams them, so that a bucket of any size can be read without holding it
+// in memory:
+//
+//	it, err := conn.Iterate(ctx, "food", connect.RangeOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Entry().Key, it.Entry().Value)
+//	}
+//	return it.Err()
+type Iterator struct {
+	resp  *http.Response
+	dec   *json.Decoder
+	entry KeyValue
+	err   error
+	done  bool
+}
+
+// streamLine is a line of a stream, which is an entry or the last line with
+// an error
+type streamLine struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+	Next  string  `json:"next"`
+	Error *struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Iterate returns an Iterator over the keys and values of a bucket in the
+// range of opts, in key order or reverse key order. The bucket is read in
+// one request that is canceled when ctx is done, and the Iterator must be
+// closed once it is no longer used.
+func (c *Connection) Iterate(ctx context.Context, bucket string, opts RangeOptions) (*Iterator, error) {
+	query := url.Values{}
+	query.Set("prefix", opts.Prefix)
+	query.Set("start", opts.Start)
+	query.Set("end", opts.End)
+	query.Set("reverse", strconv.FormatBool(opts.Reverse))
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	req, err := c.newRequest(ctx, "GET", c.bucketPath(bucket)+"/range?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{resp: resp, dec: json.NewDecoder(resp.Body)}, nil
+}
+
+// Next reads the next entry, returning false once there are none left or
+// reading failed, which is returned by Err
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	var line streamLine
+	err := it.dec.Decode(&line)
+	switch {
+	case err == io.EOF:
+		it.done = true
+		return false
+	case err != nil:
+		it.done, it.err = true, err
+		return false
+	case line.Error != nil:
+		it.done = true
+		it.err = &Error{StatusCode: line.Error.Status, Code: line.Error.Code, Message: line.Error.Message}
+		return false
+	case line.Next != "":
+		// The range stopped at its limit
+		it.done = true
+		return false
+	}
+	it.entry = KeyValue{Key: line.Key}
+	if line.Value != nil {
+		it.entry.Value = *line.Value
+	}
+	return true
+}
+
+// Entry returns the entry read by the last call to Next
+func (it *Iterator) Entry() KeyValue {
+	return it.entry
+}
+
+// Err returns the error that stopped Next, if there was one
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close stops reading the stream
+func (it *Iterator) Close() error {
+	it.done = true
+	return it.resp.Body.Close()
+}
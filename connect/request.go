@@ -0,0 +1,144 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// requestContext returns the context for a request, which is canceled after
+// the timeout of the connection if it has one
+func (c *Connection) requestContext() (context.Context, context.CancelFunc) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// newRequest creates a request to the path on the server with the headers
+// and credentials of the connection
+func (c *Connection) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.Address+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range c.headers {
+		req.Header[key] = append([]string{}, values...)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// send sends the request and returns the response if it is 200 OK, in which
+// case the caller must close its body. Otherwise it returns an *Error.
+func (c *Connection) send(req *http.Request) (*http.Response, error) {
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, errorFromResponse(resp)
+	}
+	return resp, nil
+}
+
+// do sends a request to the path on the server, with payload as the JSON
+// body if it is not nil, and decodes the JSON of the response into target if
+// it is not nil. It returns the headers of the response. Failed requests are
+// retried with the retry policy of the connection.
+func (c *Connection) do(method, path string, payload interface{}, target interface{}) (http.Header, error) {
+	var payloadBytes []byte
+	if payload != nil {
+		var err error
+		payloadBytes, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.doRaw(method, path, payloadBytes, "application/json", target)
+}
+
+// doRaw is do with a body that is already encoded as the content type. If
+// target is a *[]byte, the body of the response is read into it instead of
+// being decoded as JSON.
+func (c *Connection) doRaw(method, path string, payloadBytes []byte, contentType string, target interface{}) (http.Header, error) {
+	// Every attempt has the same key, so the server applies the request once
+	idempotencyKey := ""
+	if c.retry.MaxAttempts > 1 {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	for attempt := 1; ; attempt++ {
+		header, err := c.doOnce(method, path, payloadBytes, contentType, idempotencyKey, target)
+		if err == nil || attempt >= c.retry.MaxAttempts || !retryable(err) {
+			return header, err
+		}
+		ctx := c.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if ctx.Err() != nil {
+			return header, err
+		}
+		select {
+		case <-time.After(c.retry.backoff(attempt)):
+		case <-ctx.Done():
+			return header, err
+		}
+	}
+}
+
+// doOnce makes a single attempt of a request for do
+func (c *Connection) doOnce(method, path string, payloadBytes []byte, contentType string, idempotencyKey string, target interface{}) (http.Header, error) {
+	var body io.Reader
+	if payloadBytes != nil {
+		body = bytes.NewReader(payloadBytes)
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if payloadBytes != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if b, ok := target.(*[]byte); ok {
+		*b, err = ioutil.ReadAll(resp.Body)
+	} else if target != nil {
+		err = json.NewDecoder(resp.Body).Decode(target)
+	} else {
+		// Read the rest of the body so the connection can be reused
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	return resp.Header, err
+}
@@ -0,0 +1,118 @@
+package connect
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy retries requests that time out, that fail because the
+// connection was refused or dropped, or that get a 502, 503 or 504 from a
+// proxy in front of the server. The backoff before each retry doubles from
+// MinBackoff up to MaxBackoff, with jitter of up to half of the backoff so
+// that clients don't retry in lockstep.
+//
+// Writes, including Pop and Move, are sent with an Idempotency-Key header
+// so that the server only applies them once, however many times they are
+// retried.
+type RetryPolicy struct {
+	MaxAttempts int           // including the first attempt, so 1 never retries
+	MinBackoff  time.Duration // backoff before the first retry
+	MaxBackoff  time.Duration // longest backoff between retries
+}
+
+// DefaultRetryPolicy makes up to 4 attempts over about a second
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  2 * time.Second,
+}
+
+// WithRetry retries failed requests with the policy. Backup, Restore and
+// Watch are not retried, as their bodies are streamed.
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Connection) {
+		c.retry = policy
+	}
+}
+
+// backoff returns how long to wait before the retry after attempt, which
+// starts at 1
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.MinBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(backoff/2)+1))
+	if err != nil {
+		return backoff
+	}
+	return backoff - time.Duration(jitter.Int64())
+}
+
+// retryable returns whether a request that failed with err can be retried
+func retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		// A retry arrived while the first attempt is still being handled
+		return e.Code == "request_in_progress"
+	}
+	return transient(err)
+}
+
+// transient returns whether err is a network error that can pass, like a
+// timeout or a connection that was refused or dropped, and not a request
+// that can never be sent, like one to a server with a certificate that
+// isn't trusted or to a malformed URL
+func transient(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) || errors.As(err, &recordHeader) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		// TLS alerts, like a rejected client certificate, are sent as
+		// remote errors
+		return opErr.Op != "remote error" && opErr.Op != "local error"
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// newIdempotencyKey returns a random key for the Idempotency-Key header
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
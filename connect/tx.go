@@ -0,0 +1,122 @@
+package connect
+
+import (
+	"time"
+)
+
+type txOp struct {
+	Op         string            `json:"op"`
+	Bucket     string            `json:"bucket,omitempty"`
+	Keystore   map[string]string `json:"keystore,omitempty"`
+	TTL        string            `json:"ttl,omitempty"`
+	Keys       []string          `json:"keys,omitempty"`
+	FromBucket string            `json:"from_bucket,omitempty"`
+	ToBucket   string            `json:"to_bucket,omitempty"`
+}
+
+type txPrecondition struct {
+	Bucket  string  `json:"bucket"`
+	Key     string  `json:"key"`
+	Exists  *bool   `json:"exists,omitempty"`
+	Value   *string `json:"value,omitempty"`
+	Version *uint64 `json:"version,omitempty"`
+}
+
+// Tx builds a list of operations that are applied in order, all or nothing,
+// when it is committed. For example
+//
+//	err := conn.Tx().
+//		IfValue("accounts", "zack", "open").
+//		Put("accounts", map[string]string{"zack": "closed"}).
+//		Delete("sessions", []string{"zack"}).
+//		Commit()
+type Tx struct {
+	conn          *Connection
+	preconditions []txPrecondition
+	ops           []txOp
+}
+
+// Tx starts building a transaction on the database
+func (c *Connection) Tx() *Tx {
+	return &Tx{conn: c, preconditions: []txPrecondition{}, ops: []txOp{}}
+}
+
+// Put adds keys and values to a bucket, creating it if it does not exist
+func (t *Tx) Put(bucket string, keystore map[string]string) *Tx {
+	t.ops = append(t.ops, txOp{Op: "put", Bucket: bucket, Keystore: keystore})
+	return t
+}
+
+// PutWithTTL adds keys and values to a bucket that expire after the ttl, or
+// never expire if the ttl is not positive
+func (t *Tx) PutWithTTL(bucket string, keystore map[string]string, ttl time.Duration) *Tx {
+	op := txOp{Op: "put", Bucket: bucket, Keystore: keystore}
+	if ttl > 0 {
+		op.TTL = ttl.String()
+	}
+	t.ops = append(t.ops, op)
+	return t
+}
+
+// Delete deletes keys from a bucket
+func (t *Tx) Delete(bucket string, keys []string) *Tx {
+	t.ops = append(t.ops, txOp{Op: "delete", Bucket: bucket, Keys: keys})
+	return t
+}
+
+// Move moves keys from one bucket to another, creating the second bucket if
+// it does not exist. The transaction fails if any of the keys do not exist.
+func (t *Tx) Move(bucket string, bucket2 string, keys []string) *Tx {
+	t.ops = append(t.ops, txOp{Op: "move", FromBucket: bucket, ToBucket: bucket2, Keys: keys})
+	return t
+}
+
+// CreateBucket creates a bucket if it does not exist
+func (t *Tx) CreateBucket(bucket string) *Tx {
+	t.ops = append(t.ops, txOp{Op: "create_bucket", Bucket: bucket})
+	return t
+}
+
+// DeleteBucket deletes a bucket. The transaction fails if it does not exist.
+func (t *Tx) DeleteBucket(bucket string) *Tx {
+	t.ops = append(t.ops, txOp{Op: "delete_bucket", Bucket: bucket})
+	return t
+}
+
+// IfExists requires that the key exists in the bucket
+func (t *Tx) IfExists(bucket string, key string) *Tx {
+	exists := true
+	t.preconditions = append(t.preconditions, txPrecondition{Bucket: bucket, Key: key, Exists: &exists})
+	return t
+}
+
+// IfNotExists requires that the key does not exist in the bucket
+func (t *Tx) IfNotExists(bucket string, key string) *Tx {
+	exists := false
+	t.preconditions = append(t.preconditions, txPrecondition{Bucket: bucket, Key: key, Exists: &exists})
+	return t
+}
+
+// IfValue requires that the key exists in the bucket with the value
+func (t *Tx) IfValue(bucket string, key string, value string) *Tx {
+	t.preconditions = append(t.preconditions, txPrecondition{Bucket: bucket, Key: key, Value: &value})
+	return t
+}
+
+// IfVersion requires that the key exists in the bucket with the version
+func (t *Tx) IfVersion(bucket string, key string, version uint64) *Tx {
+	t.preconditions = append(t.preconditions, txPrecondition{Bucket: bucket, Key: key, Version: &version})
+	return t
+}
+
+// Commit applies the transaction. If a precondition does not hold it
+// returns an error matching ErrPreconditionFailed, and if any operation fails none of them
+// are applied.
+func (t *Tx) Commit() error {
+	type TxJSON struct {
+		Preconditions []txPrecondition `json:"preconditions"`
+		Ops           []txOp           `json:"ops"`
+	}
+	_, err := t.conn.do("POST", "/v1/db/"+t.conn.DBName+"/tx", TxJSON{t.preconditions, t.ops}, nil)
+	return err
+}
@@ -0,0 +1,83 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event is a change made to the database, where Type is one of put,
+// delete, move, pop or delete_bucket. Value is set for put and pop, and
+// ToBucket is set for move.
+type Event struct {
+	Type     string    `json:"type"`
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	ToBucket string    `json:"to_bucket"`
+	Time     time.Time `json:"time"`
+}
+
+// Watch returns a channel of the changes made to a bucket, or to every
+// bucket if bucket is empty. The channel is closed when ctx is done or the
+// connection to the server is lost.
+func (c *Connection) Watch(ctx context.Context, bucket string) (<-chan Event, error) {
+	return c.WatchPrefix(ctx, bucket, "")
+}
+
+// WatchPrefix returns a channel of the changes made to keys with the prefix
+// in a bucket, or in every bucket if bucket is empty. The channel is closed
+// when ctx is done or the connection to the server is lost.
+func (c *Connection) WatchPrefix(ctx context.Context, bucket string, prefix string) (<-chan Event, error) {
+	query := url.Values{}
+	query.Set("bucket", bucket)
+	query.Set("prefix", prefix)
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("/v1/db/%s/watch?%s", c.DBName, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		var eventType, data string
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				if data != "" {
+					data += "\n"
+				}
+				data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+			case line == "":
+				// A blank line ends an event
+				var e Event
+				if eventType != "" && eventType != "overflow" && eventType != "shutdown" && json.Unmarshal([]byte(data), &e) == nil {
+					select {
+					case events <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+				eventType, data = "", ""
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// access is the level of access granted on a database, where each level
+// includes the ones below it
+type access int
+
+const (
+	noAccess access = iota
+	readAccess
+	writeAccess
+	adminAccess
+)
+
+var accessNames = map[string]access{
+	"read":  readAccess,
+	"write": writeAccess,
+	"admin": adminAccess,
+}
+
+func (a access) String() string {
+	switch a {
+	case readAccess:
+		return "read"
+	case writeAccess:
+		return "write"
+	case adminAccess:
+		return "admin"
+	}
+	return "none"
+}
+
+// grant gives access to a database, or every database if DB is "*", and to
+// a bucket, or every bucket if Bucket is "*" or empty
+type grant struct {
+	DB     string `json:"db"`
+	Bucket string `json:"bucket"`
+	Access string `json:"access"`
+
+	level access
+}
+
+// authUser is someone who can sign in with basic auth, with any of their
+// API keys as a bearer token or with a client certificate whose subject is
+// one of their cert subjects, like "worker" for the common name or
+// "CN=worker,O=Acme" for the whole subject
+type authUser struct {
+	Name         string   `json:"name"`
+	Password     string   `json:"password"`
+	APIKeys      []string `json:"api_keys"`
+	CertSubjects []string `json:"cert_subjects"`
+	Grants       []grant  `json:"grants"`
+}
+
+// authConfig is the file loaded with --auth. Anonymous grants apply to
+// requests without credentials.
+type authConfig struct {
+	Users     []authUser `json:"users"`
+	Anonymous []grant    `json:"anonymous"`
+}
+
+// loadAuthConfig reads and validates the auth config file
+func loadAuthConfig(filename string) (*authConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config authConfig
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("Problem parsing %s: %s", filename, err.Error())
+	}
+
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	subjects := make(map[string]bool)
+	for i := range config.Users {
+		u := &config.Users[i]
+		if u.Name == "" {
+			return nil, fmt.Errorf("User %d must have a name", i)
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("User '%s' is listed twice", u.Name)
+		}
+		names[u.Name] = true
+		for _, key := range u.APIKeys {
+			if key == "" || keys[key] {
+				return nil, fmt.Errorf("User '%s' has an empty or duplicate API key", u.Name)
+			}
+			keys[key] = true
+		}
+		for _, subject := range u.CertSubjects {
+			if subject == "" || subjects[subject] {
+				return nil, fmt.Errorf("User '%s' has an empty or duplicate cert subject", u.Name)
+			}
+			subjects[subject] = true
+		}
+		if err = parseGrants(u.Grants); err != nil {
+			return nil, fmt.Errorf("User '%s': %s", u.Name, err.Error())
+		}
+	}
+	if err = parseGrants(config.Anonymous); err != nil {
+		return nil, fmt.Errorf("Anonymous: %s", err.Error())
+	}
+	return &config, nil
+}
+
+func parseGrants(grants []grant) error {
+	for i := range grants {
+		g := &grants[i]
+		if g.DB == "" {
+			return fmt.Errorf("Grant %d must specify db", i)
+		}
+		if g.Bucket == "" {
+			g.Bucket = "*"
+		}
+		var ok bool
+		g.level, ok = accessNames[g.Access]
+		if !ok {
+			return fmt.Errorf("Grant %d has unknown access '%s'", i, g.Access)
+		}
+	}
+	return nil
+}
+
+// secureCompare compares two secrets in constant time
+func secureCompare(a string, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// authenticate returns the grants for the credentials of a request. It
+// returns ok as false if credentials were given but are not valid. Requests
+// without an Authorization header are signed in by their client certificate,
+// if it was verified and belongs to a user.
+func (config *authConfig) authenticate(r *http.Request) (name string, grants []grant, ok bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		if u := config.certUser(r.TLS); u != nil {
+			return u.Name, u.Grants, true
+		}
+		return "", config.Anonymous, true
+	}
+
+	if strings.HasPrefix(header, "Bearer ") {
+		key := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		for _, u := range config.Users {
+			for _, k := range u.APIKeys {
+				if secureCompare(k, key) {
+					return u.Name, u.Grants, true
+				}
+			}
+		}
+		return "", nil, false
+	}
+
+	username, password, hasBasic := r.BasicAuth()
+	if !hasBasic {
+		return "", nil, false
+	}
+	for _, u := range config.Users {
+		// Users without a password can only use their API keys
+		if u.Name == username && u.Password != "" && secureCompare(u.Password, password) {
+			return u.Name, u.Grants, true
+		}
+	}
+	return "", nil, false
+}
+
+// certUser returns the user of the verified client certificate of a
+// connection, or nil if there is none
+func (config *authConfig) certUser(state *tls.ConnectionState) *authUser {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	subject := state.PeerCertificates[0].Subject
+	for i, u := range config.Users {
+		for _, s := range u.CertSubjects {
+			if s == subject.CommonName || s == subject.String() {
+				return &config.Users[i]
+			}
+		}
+	}
+	return nil
+}
+
+// accessTo returns the highest level of access the grants give to a bucket
+// of a database. If bucket is empty, only grants on every bucket count.
+func accessTo(grants []grant, dbname string, bucket string) access {
+	level := noAccess
+	for _, g := range grants {
+		if g.DB != "*" && g.DB != dbname {
+			continue
+		}
+		if g.Bucket != "*" && (bucket == "" || !inBucket(bucket, g.Bucket)) {
+			continue
+		}
+		if g.level > level {
+			level = g.level
+		}
+	}
+	return level
+}
+
+// authorize returns middleware that requires the level of access to the
+// database and bucket of the route. Routes without a bucket require access
+// to every bucket of the database.
+func (s *Server) authorize(level access) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.auth == nil {
+			return
+		}
+		name, grants, ok := s.auth.authenticate(c.Request)
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="boltdb-server"`)
+			respondError(c, &apiError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: "Invalid credentials"})
+			return
+		}
+		c.Set("user", name)
+		c.Set("grants", grants)
+		if s.hasAccess(c, c.Param("bucket"), level) {
+			return
+		}
+		if name == "" && c.GetHeader("Authorization") == "" {
+			c.Header("WWW-Authenticate", `Basic realm="boltdb-server"`)
+			respondError(c, &apiError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: "Credentials required"})
+			return
+		}
+		s.log.Info("%s denied %s access to %s", name, level, c.Param("dbname"))
+		respondError(c, &apiError{Status: http.StatusForbidden, Code: codeForbidden, Message: fmt.Sprintf("Requires %s access", level)})
+	}
+}
+
+// hasAccess returns whether the authorized request has the level of access
+// to a bucket of its database, for handlers that need more than the route
+func (s *Server) hasAccess(c *gin.Context, bucket string, level access) bool {
+	if s.auth == nil {
+		return true
+	}
+	grants, _ := c.Get("grants")
+	g, _ := grants.([]grant)
+	return accessTo(g, c.Param("dbname"), bucket) >= level
+}
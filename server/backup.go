@@ -0,0 +1,101 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// backupDatabase writes a consistent snapshot of a database to w while it
+// continues to serve reads and writes
+func (s *Server) backupDatabase(dbname string, w io.Writer) error {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.View(func(tx *bolt.Tx) error {
+		if rw, ok := w.(http.ResponseWriter); ok {
+			rw.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		}
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// snapshotError is returned when restoring a snapshot that is not a bolt database
+type snapshotError struct {
+	err error
+}
+
+func (e *snapshotError) Error() string {
+	return "Problem with snapshot: " + e.err.Error()
+}
+
+// restoreDatabase replaces a database with the snapshot read from r. The
+// snapshot is written to a temporary file and checked before it replaces
+// the database, so a failed restore leaves the database as it was.
+func (s *Server) restoreDatabase(dbname string, r io.Reader) (err error) {
+	filename, err := s.dbFilename(dbname)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dbpath, dbname+".db.restore-")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = checkDatabaseFile(tempPath)
+	if err != nil {
+		return &snapshotError{err}
+	}
+
+	// Close the database once it is no longer used and replace it, so it
+	// can't be opened again until it is replaced
+	s.dbs.Lock()
+	defer s.dbs.Unlock()
+	defer s.closeDB(dbname)()
+	return os.Rename(tempPath, filename)
+}
+
+// checkDatabaseFile returns an error if the file is not a consistent bolt database
+func checkDatabaseFile(filename string) error {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true, Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) (err error) {
+		// Drain every error so the check finishes before the tx is closed
+		for checkErr := range tx.Check() {
+			if err == nil {
+				err = checkErr
+			}
+		}
+		return err
+	})
+}
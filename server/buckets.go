@@ -0,0 +1,188 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketSeparator separates the names of nested buckets in a bucket path,
+// like users/2024/active. In routes it is escaped as %2F.
+const bucketSeparator = "/"
+
+// inBucket returns whether the bucket at path is bucket or nested in it
+func inBucket(path string, bucket string) bool {
+	return path == bucket || strings.HasPrefix(path, bucket+bucketSeparator)
+}
+
+// resolveBucket returns the bucket at a path, or nil if it or one of its
+// parents does not exist
+func resolveBucket(tx *bolt.Tx, bucket string) *bolt.Bucket {
+	names := strings.Split(bucket, bucketSeparator)
+	b := tx.Bucket([]byte(names[0]))
+	for _, name := range names[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(name))
+	}
+	return b
+}
+
+// createBucketPath returns the bucket at a path, creating it and its parents
+// if they do not exist
+func createBucketPath(tx *bolt.Tx, bucket string) (*bolt.Bucket, error) {
+	names := strings.Split(bucket, bucketSeparator)
+	b, err := tx.CreateBucketIfNotExists([]byte(names[0]))
+	for i := 1; i < len(names) && err == nil; i++ {
+		b, err = b.CreateBucketIfNotExists([]byte(names[i]))
+	}
+	if err == bolt.ErrIncompatibleValue {
+		return nil, incompatibleValue("Can't create bucket '%s' where there is a key", bucket)
+	}
+	return b, err
+}
+
+// deleteBucketPath deletes the bucket at a path and every bucket in it
+func deleteBucketPath(tx *bolt.Tx, bucket string) error {
+	i := strings.LastIndex(bucket, bucketSeparator)
+	if i < 0 {
+		return tx.DeleteBucket([]byte(bucket))
+	}
+	parent := resolveBucket(tx, bucket[:i])
+	if parent == nil {
+		return bolt.ErrBucketNotFound
+	}
+	return parent.DeleteBucket([]byte(bucket[i+1:]))
+}
+
+// childBuckets returns the names of the buckets in a bucket, or of the top
+// level buckets if bucket is empty
+func childBuckets(tx *bolt.Tx, bucket string) ([]string, error) {
+	names := []string{}
+	if bucket == "" {
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !isReservedBucket(string(name)) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		return names, err
+	}
+	b := resolveBucket(tx, bucket)
+	if b == nil {
+		return names, bucketNotFound(bucket)
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// bucketPaths returns the paths of every bucket, nested or not, in order
+func bucketPaths(tx *bolt.Tx) []string {
+	var paths []string
+	var walk func(prefix string, b *bolt.Bucket)
+	walk = func(prefix string, b *bolt.Bucket) {
+		b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				path := prefix + bucketSeparator + string(k)
+				paths = append(paths, path)
+				walk(path, b.Bucket(k))
+			}
+			return nil
+		})
+	}
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if !isReservedBucket(string(name)) {
+			paths = append(paths, string(name))
+			walk(string(name), b)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths
+}
+
+// bucketTree is a bucket with the number of keys in it and the buckets in it
+type bucketTree struct {
+	Name    string       `json:"name"`
+	Path    string       `json:"path"`
+	Keys    int          `json:"keys"`
+	Buckets []bucketTree `json:"buckets"`
+}
+
+// walkBucketTree returns the tree of the bucket at a path, or of every bucket
+// if bucket is empty
+func walkBucketTree(tx *bolt.Tx, bucket string) (tree bucketTree, err error) {
+	tree.Path = bucket
+	tree.Buckets = []bucketTree{}
+	if bucket != "" {
+		tree.Name = bucket[strings.LastIndex(bucket, bucketSeparator)+1:]
+		if resolveBucket(tx, bucket) == nil {
+			return tree, bucketNotFound(bucket)
+		}
+	}
+	children, err := childBuckets(tx, bucket)
+	if err != nil {
+		return tree, err
+	}
+	for _, child := range children {
+		path := child
+		if bucket != "" {
+			path = bucket + bucketSeparator + child
+		}
+		subtree, err := walkBucketTree(tx, path)
+		if err != nil {
+			return tree, err
+		}
+		tree.Buckets = append(tree.Buckets, subtree)
+	}
+	if bucket != "" {
+		mb := keyMetaBucket(tx, bucket)
+		now := time.Now()
+		resolveBucket(tx, bucket).ForEach(func(k, v []byte) error {
+			if v != nil && !isExpired(mb, k, now) {
+				tree.Keys++
+			}
+			return nil
+		})
+	}
+	return tree, nil
+}
+
+// getChildBuckets returns the names of the buckets in a bucket
+func (s *Server) getChildBuckets(dbname string, bucket string) (names []string, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return names, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		names, err = childBuckets(tx, bucket)
+		return err
+	})
+	return names, err
+}
+
+// getBucketTree returns the tree of a bucket, or of every bucket if bucket
+// is empty
+func (s *Server) getBucketTree(dbname string, bucket string) (tree bucketTree, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return tree, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		tree, err = walkBucketTree(tx, bucket)
+		return err
+	})
+	return tree, err
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+// dbCache holds the open databases of a server. Databases stay open between
+// requests and are closed once they have been idle for Config.IdleTimeout,
+// or in least recently used order when more than Config.MaxOpen are open.
+// Pinned databases and databases that are being used are never closed by
+// the cache, so MaxOpen is exceeded only while more databases than that are
+// in use at once.
+type dbCache struct {
+	sync.Mutex
+	handles  map[string]*dbHandle
+	lru      *list.List // of *dbHandle, most recently used first
+	pinned   map[string]bool
+	opening  map[string]bool // databases being opened, without holding the lock
+	closing  map[string]bool // databases being closed by closeDB
+	released *sync.Cond      // broadcast when a database is no longer used, opening or closing
+
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+	idleCloses uint64
+}
+
+// dbHandle is an open database
+type dbHandle struct {
+	dbname   string
+	db       *bolt.DB
+	lastUsed time.Time
+	refs     int // requests and sweeps using the database
+	elem     *list.Element
+}
+
+// CacheStats are the counters of the database handle cache
+type CacheStats struct {
+	Open       int    `json:"open"`        // databases that are open
+	InUse      int    `json:"in_use"`      // open databases being used by requests
+	MaxOpen    int    `json:"max_open"`    // most databases kept open, or 0 for no limit
+	Hits       uint64 `json:"hits"`        // requests that found their database open
+	Misses     uint64 `json:"misses"`      // requests that opened their database
+	Evictions  uint64 `json:"evictions"`   // databases closed to keep under MaxOpen
+	IdleCloses uint64 `json:"idle_closes"` // databases closed after IdleTimeout
+}
+
+// getDB returns the open database, opening or creating it if needed, and a
+// function that must be called once the database is no longer used
+func (s *Server) getDB(dbname string) (*bolt.DB, func(), error) {
+	return s.openDB(dbname, true)
+}
+
+// getExistingDB is getDB for requests that only use what is already in the
+// database, which returns dbNotFound instead of creating it
+func (s *Server) getExistingDB(dbname string) (*bolt.DB, func(), error) {
+	return s.openDB(dbname, false)
+}
+
+func (s *Server) openDB(dbname string, create bool) (*bolt.DB, func(), error) {
+	s.dbs.Lock()
+	defer s.dbs.Unlock()
+	for {
+		select {
+		case <-s.done:
+			// Don't open databases again once they have been closed
+			return nil, nil, errShuttingDown
+		default:
+		}
+		if !s.dbs.opening[dbname] && !s.dbs.closing[dbname] {
+			break
+		}
+		// Wait for the database to be opened by another request, or removed
+		// or replaced
+		s.dbs.released.Wait()
+	}
+	h, ok := s.dbs.handles[dbname]
+	if ok {
+		s.dbs.hits++
+		s.dbs.lru.MoveToFront(h.elem)
+	} else {
+		s.dbs.misses++
+		filename, err := s.dbFilename(dbname)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !create && !s.databaseExists(dbname) {
+			return nil, nil, dbNotFound(dbname)
+		}
+		db, err := s.openFile(dbname, filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		h = &dbHandle{dbname: dbname, db: db}
+		h.elem = s.dbs.lru.PushFront(h)
+		s.dbs.handles[dbname] = h
+	}
+	h.refs++
+	h.lastUsed = time.Now()
+	s.evictDBs()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.dbs.Lock()
+			defer s.dbs.Unlock()
+			h.lastUsed = time.Now()
+			s.releaseHandle(h)
+			s.evictDBs()
+		})
+	}
+	return h.db, release, nil
+}
+
+// openFile opens the file of a database that isn't open. The lock on the
+// file can be held by another process, like boltdb-server migrate, so s.dbs
+// is unlocked while waiting for it, and requests for the database wait until
+// it is open. s.dbs must be locked.
+func (s *Server) openFile(dbname string, filename string) (*bolt.DB, error) {
+	s.dbs.opening[dbname] = true
+	s.dbs.Unlock()
+	s.log.Debug("Opening %s", dbname)
+	db, err := bolt.Open(filename, 0755, &bolt.Options{
+		Timeout:         s.config.OpenTimeout,
+		InitialMmapSize: s.config.InitialMmapSize,
+	})
+	s.dbs.Lock()
+	delete(s.dbs.opening, dbname)
+	s.dbs.released.Broadcast()
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %s", dbname, err.Error())
+	}
+	select {
+	case <-s.done:
+		// The server was closed while opening
+		db.Close()
+		return nil, errShuttingDown
+	default:
+	}
+	db.NoSync = s.config.NoSync
+	return db, nil
+}
+
+// releaseHandle stops counting a use of a database, waking closeDB once it
+// is no longer used, and closes it if the server was closed while it was
+// being used. s.dbs must be locked.
+func (s *Server) releaseHandle(h *dbHandle) {
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	s.dbs.released.Broadcast()
+	select {
+	case <-s.done:
+		if s.dbs.handles[h.dbname] == h {
+			s.log.Debug("Closing %s once it is no longer used", h.dbname)
+			if err := s.closeHandle(h); err != nil {
+				s.log.Error("Could not close %s: %s", h.dbname, err.Error())
+			}
+		}
+	default:
+	}
+}
+
+// evictDBs closes the least recently used databases that are not pinned or
+// being used until no more than MaxOpen are open. s.dbs must be locked.
+func (s *Server) evictDBs() {
+	if s.config.MaxOpen <= 0 {
+		return
+	}
+	for e := s.dbs.lru.Back(); e != nil && len(s.dbs.handles) > s.config.MaxOpen; {
+		h := e.Value.(*dbHandle)
+		e = e.Prev()
+		if h.refs > 0 || s.dbs.pinned[h.dbname] {
+			continue
+		}
+		s.log.Debug("Evicting %s", h.dbname)
+		s.closeHandle(h)
+		s.dbs.evictions++
+	}
+}
+
+// closeHandle closes a database and removes it from the cache. s.dbs must be
+// locked.
+func (s *Server) closeHandle(h *dbHandle) error {
+	delete(s.dbs.handles, h.dbname)
+	s.dbs.lru.Remove(h.elem)
+	return h.db.Close()
+}
+
+// closeDB closes a database once the requests using it have released it,
+// so that its file can be removed or replaced, and makes new requests for it
+// wait until the returned function is called. Closing a database that
+// transactions are using would unmap their memory. s.dbs must be locked, and
+// is unlocked while waiting so other databases can be used.
+func (s *Server) closeDB(dbname string) func() {
+	for s.dbs.opening[dbname] || s.dbs.closing[dbname] {
+		s.dbs.released.Wait()
+	}
+	s.dbs.closing[dbname] = true
+	for {
+		h, ok := s.dbs.handles[dbname]
+		if !ok {
+			break
+		}
+		if h.refs == 0 {
+			s.closeHandle(h)
+			break
+		}
+		s.log.Debug("Waiting for %s to be released", dbname)
+		s.dbs.released.Wait()
+	}
+	return func() {
+		delete(s.dbs.closing, dbname)
+		s.dbs.released.Broadcast()
+	}
+}
+
+// closeDBs periodically closes the databases that have not been used for the
+// idle timeout, until the server is closed
+func (s *Server) closeDBs() {
+	interval := s.config.IdleTimeout
+	if interval > s.config.SweepInterval {
+		interval = s.config.SweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.dbs.Lock()
+		for e := s.dbs.lru.Back(); e != nil; {
+			h := e.Value.(*dbHandle)
+			e = e.Prev()
+			if h.refs > 0 || s.dbs.pinned[h.dbname] || time.Since(h.lastUsed) <= s.config.IdleTimeout {
+				continue
+			}
+			s.log.Debug("Closing %s", h.dbname)
+			s.closeHandle(h)
+			s.dbs.idleCloses++
+		}
+		s.dbs.Unlock()
+	}
+}
+
+// openDBs returns the open databases and a function that must be called once
+// they are no longer used, which keeps them open without counting as a use
+func (s *Server) openDBs() (map[string]*bolt.DB, func()) {
+	s.dbs.Lock()
+	defer s.dbs.Unlock()
+	handles := make([]*dbHandle, 0, len(s.dbs.handles))
+	dbs := make(map[string]*bolt.DB)
+	for dbname, h := range s.dbs.handles {
+		h.refs++
+		handles = append(handles, h)
+		dbs[dbname] = h.db
+	}
+	return dbs, func() {
+		s.dbs.Lock()
+		defer s.dbs.Unlock()
+		for _, h := range handles {
+			s.releaseHandle(h)
+		}
+		s.evictDBs()
+	}
+}
+
+// closeAllDBs closes every open database, returning an error that lists the
+// ones that could not be closed. Databases that are still being used are
+// closed once they are released instead, since closing them would unmap the
+// memory of their transactions.
+func (s *Server) closeAllDBs() error {
+	s.dbs.Lock()
+	defer s.dbs.Unlock()
+	// Wake the requests waiting for closeDB, so they see the server is closed
+	defer s.dbs.released.Broadcast()
+	var failed []string
+	for dbname, h := range s.dbs.handles {
+		if h.refs > 0 {
+			s.log.Warn("Not closing %s, which is still being used", dbname)
+			failed = append(failed, dbname+": still being used, will be closed once released")
+			continue
+		}
+		if err := s.closeHandle(h); err != nil {
+			s.log.Error("Could not close %s: %s", dbname, err.Error())
+			failed = append(failed, dbname+": "+err.Error())
+		} else {
+			s.log.Debug("Closed %s", dbname)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("Could not close %d databases: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// CacheStats returns the counters of the database handle cache
+func (s *Server) CacheStats() CacheStats {
+	s.dbs.Lock()
+	defer s.dbs.Unlock()
+	stats := CacheStats{
+		Open:       len(s.dbs.handles),
+		MaxOpen:    s.config.MaxOpen,
+		Hits:       s.dbs.hits,
+		Misses:     s.dbs.misses,
+		Evictions:  s.dbs.evictions,
+		IdleCloses: s.dbs.idleCloses,
+	}
+	for _, h := range s.dbs.handles {
+		if h.refs > 0 {
+			stats.InUse++
+		}
+	}
+	return stats
+}
+
+func (s *Server) handleCacheStats(c *gin.Context) {
+	c.JSON(200, s.CacheStats())
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec is the marker byte that starts every stored value and says how the
+// rest of it is compressed. The markers can't start UTF-8 text or data
+// written by compress/flate, so values written before there were markers
+// are still read correctly.
+type codec byte
+
+const (
+	codecNone   codec = 0xF5
+	codecFlate  codec = 0xF6
+	codecGzip   codec = 0xF7
+	codecZstd   codec = 0xFC
+	codecSnappy codec = 0xFD
+)
+
+// codecs are the values of Config.Codec
+var codecs = map[string]codec{
+	"none":   codecNone,
+	"flate":  codecFlate,
+	"gzip":   codecGzip,
+	"zstd":   codecZstd,
+	"snappy": codecSnappy,
+}
+
+// zstd encoders and decoders are safe to share for EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// valueCodec returns the codec that new values are compressed with
+func (config Config) valueCodec() codec {
+	if c, ok := codecs[config.Codec]; ok {
+		return c
+	}
+	if config.Compress {
+		return codecFlate
+	}
+	return codecNone
+}
+
+// encodeValue returns the stored bytes of a value, compressed with the codec
+// of the server unless it is smaller than Config.CompressMinSize or doesn't
+// get smaller
+func (s *Server) encodeValue(value string) []byte {
+	return s.encodeValueWith(s.codec, value)
+}
+
+// encodeValueWith is encodeValue with another codec than the server's
+func (s *Server) encodeValueWith(c codec, value string) []byte {
+	if len(value) < s.config.CompressMinSize {
+		c = codecNone
+	}
+	encoded, err := encode(c, []byte(value))
+	if err != nil || len(encoded) >= len(value) {
+		c, encoded = codecNone, []byte(value)
+	}
+	return append([]byte{byte(c)}, encoded...)
+}
+
+// encode compresses src with a codec
+func encode(c codec, src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case codecNone:
+		return src, nil
+	case codecZstd:
+		return zstdEncoder.EncodeAll(src, nil), nil
+	case codecSnappy:
+		return snappy.Encode(nil, src), nil
+	case codecFlate:
+		w, _ = flate.NewWriter(&buf, flate.BestCompression)
+	case codecGzip:
+		w, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	default:
+		return nil, fmt.Errorf("Unknown codec %#x", byte(c))
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeValue returns a stored value, whatever codec it was written with.
+// Values without a marker were written before there were markers, as raw
+// text or, by servers with compression on, as flate.
+func (s *Server) decodeValue(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", nil
+	}
+	var (
+		decoded []byte
+		err     error
+	)
+	switch c := codec(b[0]); c {
+	case codecNone, codecFlate, codecGzip, codecZstd, codecSnappy:
+		decoded, err = decode(c, b[1:])
+	default:
+		if utf8.Valid(b) {
+			return string(b), nil
+		}
+		decoded, err = decode(codecFlate, b)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// decode decompresses src with a codec
+func decode(c codec, src []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch c {
+	case codecNone:
+		return src, nil
+	case codecZstd:
+		return zstdDecoder.DecodeAll(src, nil)
+	case codecSnappy:
+		return snappy.Decode(nil, src)
+	case codecFlate:
+		r = flate.NewReader(bytes.NewReader(src))
+	case codecGzip:
+		var err error
+		if r, err = gzip.NewReader(bytes.NewReader(src)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown codec %#x", byte(c))
+	}
+	defer r.Close()
+	decoded, err := ioutil.ReadAll(r)
+	if err == io.ErrUnexpectedEOF {
+		err = errors.New("value is truncated")
+	}
+	return decoded, err
+}
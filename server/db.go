@@ -0,0 +1,703 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// sweepDBs periodically deletes the keys that have passed their TTL and
+// redelivers the keys of expired leases in every open database, until the
+// server is closed
+func (s *Server) sweepDBs() {
+	ticker := time.NewTicker(s.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		openDBs, release := s.openDBs()
+		for dbname, db := range openDBs {
+			n, err := deleteExpiredKeys(db)
+			if err != nil {
+				s.log.Debug("Could not expire keys in %s: %s", dbname, err.Error())
+			} else if n > 0 {
+				s.log.Debug("Expired %d keys in %s", n, dbname)
+			}
+			n, err = redeliverExpiredLeases(db)
+			if err != nil {
+				s.log.Debug("Could not redeliver leases in %s: %s", dbname, err.Error())
+			} else if n > 0 {
+				s.log.Debug("Redelivered %d leased keys in %s", n, dbname)
+			}
+		}
+		release()
+		if n := s.forgetIdempotentResponses(); n > 0 {
+			s.log.Debug("Forgot %d idempotent responses", n)
+		}
+	}
+}
+
+func (s *Server) getNumberKeysInBucket(dbname string, bucket string) (n int, err error) {
+	n = 0
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return n, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		mb := keyMetaBucket(tx, bucket)
+		now := time.Now()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil && !isExpired(mb, k, now) {
+				n++
+			}
+		}
+		return nil
+	})
+	s.log.Trace("Found %d keys in bucket '%s' in db '%s'", n, bucket, dbname)
+	return n, err
+}
+
+func (s *Server) getBucketNames(dbname string) (bucketNames []string, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return bucketNames, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !isReservedBucket(string(name)) {
+				bucketNames = append(bucketNames, string(name))
+			}
+			return nil
+		})
+	})
+	return bucketNames, err
+}
+
+func (s *Server) createDatabase(dbname string, buckets []string) error {
+	db, release, err := s.getDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return createBucketsInTx(tx, buckets)
+	})
+}
+
+func createBucketsInTx(tx *bolt.Tx, buckets []string) error {
+	for _, bucket := range buckets {
+		_, err := createBucketPath(tx, bucket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeConditions must hold for every key of an update before any of them
+// are written
+type writeConditions struct {
+	IfExists   bool              // keys must exist
+	IfAbsent   bool              // keys must not exist
+	IfValues   map[string]string // keys must exist with these values
+	IfVersions map[string]uint64 // keys must exist with these versions
+}
+
+// conflictError is returned when a write condition does not hold, with the
+// current state of the key
+type conflictError struct {
+	apiError
+	Key     string `json:"key"`
+	Exists  bool   `json:"exists"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+func (e *conflictError) Error() string {
+	return "Conflicting write to '" + e.Key + "'"
+}
+
+// checkWriteConditions returns a *conflictError for the first key of the
+// keystore whose write condition does not hold
+func (s *Server) checkWriteConditions(tx *bolt.Tx, bucket string, keystore map[string]string, conds writeConditions) error {
+	if !conds.IfExists && !conds.IfAbsent && len(conds.IfValues) == 0 && len(conds.IfVersions) == 0 {
+		return nil
+	}
+	b := resolveBucket(tx, bucket)
+	mb := keyMetaBucket(tx, bucket)
+	now := time.Now()
+	for key := range keystore {
+		current := &conflictError{Key: key}
+		current.apiError = apiError{Status: http.StatusConflict, Code: codeConflict, Message: current.Error()}
+		if b != nil {
+			m := readKeyMeta(mb, []byte(key))
+			if v := b.Get([]byte(key)); v != nil && !m.expired(now) {
+				value, err := s.decodeValue(v)
+				if err != nil {
+					return corruptValue(bucket, key, err)
+				}
+				current.Exists = true
+				current.Value = value
+				current.Version = m.Version
+			}
+		}
+		if conds.IfExists && !current.Exists {
+			return current
+		}
+		if conds.IfAbsent && current.Exists {
+			return current
+		}
+		if value, ok := conds.IfValues[key]; ok && (!current.Exists || current.Value != value) {
+			return current
+		}
+		if version, ok := conds.IfVersions[key]; ok && (!current.Exists || current.Version != version) {
+			return current
+		}
+	}
+	return nil
+}
+
+// updateDatabase puts the keys and values into the bucket, creating it if
+// needed. Keys with a TTL in ttls expire after it has passed, and any other
+// keys have their previous TTL cleared. Nothing is written if any of the
+// write conditions do not hold. It returns the new version of each key.
+func (s *Server) updateDatabase(dbname string, bucket string, keystore map[string]string, ttls map[string]time.Duration, conds writeConditions) (versions map[string]uint64, err error) {
+	db, release, err := s.getDB(dbname)
+	if err != nil {
+		return versions, err
+	}
+	defer release()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		err := s.checkWriteConditions(tx, bucket, keystore, conds)
+		if err != nil {
+			return err
+		}
+		versions, err = s.putKeysInTx(tx, bucket, keystore, ttls)
+		return err
+	})
+	return versions, err
+}
+
+// putKeysInTx writes the keys and values and returns the new version of each key
+func (s *Server) putKeysInTx(tx *bolt.Tx, bucket string, keystore map[string]string, ttls map[string]time.Duration) (versions map[string]uint64, err error) {
+	versions = make(map[string]uint64)
+	b, err := createBucketPath(tx, bucket)
+	if err != nil {
+		return versions, err
+	}
+	now := time.Now()
+	for key, value := range keystore {
+		err = b.Put([]byte(key), s.encodeValue(value))
+		if err == bolt.ErrIncompatibleValue {
+			return versions, incompatibleValue("Can't write key '%s' where there is a bucket", key)
+		} else if err != nil {
+			return versions, err
+		}
+		var m keyMeta
+		if ttl := ttls[key]; ttl > 0 {
+			m.Expires = now.Add(ttl).UnixNano()
+		}
+		m.Version, err = nextVersion(tx)
+		if err != nil {
+			return versions, err
+		}
+		err = writeKeyMeta(tx, bucket, []byte(key), m)
+		if err != nil {
+			return versions, err
+		}
+		versions[key] = m.Version
+	}
+	return versions, nil
+}
+
+func (s *Server) getKeysFromDatabase(dbname string, bucket string) (keys []string, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return []string{}, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		// Assume bucket exists and has keys
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		keys = []string{}
+		mb := keyMetaBucket(tx, bucket)
+		now := time.Now()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil && !isExpired(mb, k, now) {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// getFromDatabase returns the values of the keys, or of every key in the
+// bucket if none are specified, along with their versions
+func (s *Server) getFromDatabase(dbname string, bucket string, keys []string) (map[string]string, map[string]uint64, error) {
+	keystore := make(map[string]string)
+	versions := make(map[string]uint64)
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return keystore, versions, err
+	}
+	defer release()
+
+	if len(keys) == 0 {
+		// Get all keys
+		err = db.View(func(tx *bolt.Tx) error {
+			// Assume bucket exists and has keys
+			b := resolveBucket(tx, bucket)
+			if b == nil {
+				return bucketNotFound(bucket)
+			}
+			mb := keyMetaBucket(tx, bucket)
+			now := time.Now()
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if v == nil {
+					continue
+				}
+				if m := readKeyMeta(mb, k); !m.expired(now) {
+					value, err := s.decodeValue(v)
+					if err != nil {
+						return corruptValue(bucket, string(k), err)
+					}
+					keystore[string(k)] = value
+					versions[string(k)] = m.Version
+				}
+			}
+			return nil
+		})
+	} else {
+		// Get specified keys
+		err = db.View(func(tx *bolt.Tx) error {
+			b := resolveBucket(tx, bucket)
+			if b == nil {
+				return bucketNotFound(bucket)
+			}
+			mb := keyMetaBucket(tx, bucket)
+			now := time.Now()
+			for _, key := range keys {
+				v := b.Get([]byte(key))
+				if v == nil {
+					continue
+				}
+				if m := readKeyMeta(mb, []byte(key)); !m.expired(now) {
+					value, err := s.decodeValue(v)
+					if err != nil {
+						return corruptValue(bucket, key, err)
+					}
+					keystore[key] = value
+					versions[key] = m.Version
+				}
+			}
+			return nil
+		})
+	}
+	return keystore, versions, err
+}
+
+// rangeQuery describes an ordered scan over a bucket. Start is inclusive, End
+// is exclusive and Token is the continuation token from a previous page.
+type rangeQuery struct {
+	Prefix  string
+	Start   string
+	End     string
+	Limit   int
+	Reverse bool
+	Token   string
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// encodeRangeToken returns the opaque continuation token for resuming a scan at key
+func encodeRangeToken(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// decodeRangeToken returns the key that a continuation token resumes at
+func decodeRangeToken(token string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(key) == 0 {
+		return nil, badRequest("Invalid continuation token")
+	}
+	return key, nil
+}
+
+// prefixEnd returns the first key that sorts after every key with the prefix,
+// or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// getRangeFromDatabase returns up to q.Limit keys and values in key order
+// (or reverse key order) using a cursor, along with a continuation token
+// if there are more keys in the range.
+func (s *Server) getRangeFromDatabase(dbname string, bucket string, q rangeQuery) (entries []keyValue, next string, err error) {
+	entries = []keyValue{}
+
+	var token []byte
+	if q.Token != "" {
+		token, err = decodeRangeToken(q.Token)
+		if err != nil {
+			return entries, next, err
+		}
+	}
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return entries, next, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		next, err = scanRange(tx, bucket, q, token, func(k, v []byte) error {
+			value, err := s.decodeValue(v)
+			if err != nil {
+				return corruptValue(bucket, string(k), err)
+			}
+			entries = append(entries, keyValue{Key: string(k), Value: value})
+			return nil
+		})
+		return err
+	})
+	return entries, next, err
+}
+
+// scanRange calls fn with the keys and stored values of the range of a
+// bucket in order, resuming at token if it is not nil. It stops after
+// q.Limit keys, if q.Limit is not 0, and returns the continuation token if
+// there are more keys in the range.
+func scanRange(tx *bolt.Tx, bucket string, q rangeQuery, token []byte, fn func(k, v []byte) error) (next string, err error) {
+	prefix := []byte(q.Prefix)
+	lower := []byte(q.Start)
+	if bytes.Compare(prefix, lower) > 0 {
+		lower = prefix
+	}
+	var upper []byte
+	if q.End != "" {
+		upper = []byte(q.End)
+	}
+	if end := prefixEnd(prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+		upper = end
+	}
+
+	b := resolveBucket(tx, bucket)
+	if b == nil {
+		return next, bucketNotFound(bucket)
+	}
+	mb := keyMetaBucket(tx, bucket)
+	now := time.Now()
+	c := b.Cursor()
+
+	var k, v []byte
+	step := c.Next
+	if !q.Reverse {
+		if token != nil && bytes.Compare(token, lower) > 0 {
+			k, v = c.Seek(token)
+		} else {
+			k, v = c.Seek(lower)
+		}
+	} else {
+		step = c.Prev
+		// The token is the next key to read, unless it is past the end,
+		// which is never read
+		from, inclusive := upper, false
+		if token != nil && (upper == nil || bytes.Compare(token, upper) < 0) {
+			from, inclusive = token, true
+		}
+		if from == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Seek(from)
+			if k == nil {
+				k, v = c.Last()
+			} else if !inclusive || !bytes.Equal(k, from) {
+				k, v = c.Prev()
+			}
+		}
+	}
+
+	n := 0
+	for ; k != nil; k, v = step() {
+		if !bytes.HasPrefix(k, prefix) ||
+			(!q.Reverse && upper != nil && bytes.Compare(k, upper) >= 0) ||
+			(q.Reverse && bytes.Compare(k, lower) < 0) {
+			break
+		}
+		if v == nil || isExpired(mb, k, now) {
+			// Skip nested buckets and expired keys
+			continue
+		}
+		if n == q.Limit && q.Limit > 0 {
+			return encodeRangeToken(k), nil
+		}
+		if err := fn(k, v); err != nil {
+			return next, err
+		}
+		n++
+	}
+	return next, nil
+}
+
+// databaseExists returns whether there is a database file for dbname
+func (s *Server) databaseExists(dbname string) bool {
+	filename, err := s.dbFilename(dbname)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filename)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (s *Server) deleteDatabase(dbname string) error {
+	filename, err := s.dbFilename(dbname)
+	if err != nil {
+		return err
+	}
+	if !s.databaseExists(dbname) {
+		return dbNotFound(dbname)
+	}
+
+	// Close the database once it is no longer used and remove it, so it
+	// can't be opened again until it is removed
+	s.dbs.Lock()
+	defer s.dbs.Unlock()
+	defer s.closeDB(dbname)()
+	err = os.Remove(filename)
+	if os.IsNotExist(err) {
+		// It was deleted while waiting for it to be released
+		return dbNotFound(dbname)
+	}
+	return err
+}
+
+func (s *Server) deleteKeys(dbname string, bucket string, keys []string) error {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteKeysInTx(tx, bucket, keys)
+	})
+}
+
+func deleteKeysInTx(tx *bolt.Tx, bucket string, keys []string) error {
+	b := resolveBucket(tx, bucket)
+	if b == nil {
+		return bucketNotFound(bucket)
+	}
+	for _, key := range keys {
+		err := b.Delete([]byte(key))
+		if err != nil {
+			return err
+		}
+		err = deleteKeyMeta(tx, bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) deleteBucket(dbname string, bucket string) error {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteBucketInTx(tx, bucket)
+	})
+}
+
+func deleteBucketInTx(tx *bolt.Tx, bucket string) error {
+	err := deleteBucketPath(tx, bucket)
+	if err == bolt.ErrBucketNotFound {
+		return bucketNotFound(bucket)
+	} else if err != nil {
+		return err
+	}
+	return deleteBucketMeta(tx, bucket)
+}
+
+func (s *Server) pop(dbname string, bucket string, n int) (map[string]string, error) {
+	keystore := make(map[string]string)
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return keystore, err
+	}
+	defer release()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+
+		mb := keyMetaBucket(tx, bucket)
+		now := time.Now()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v == nil || isExpired(mb, k, now) {
+				// Skip nested buckets and expired keys
+				continue
+			}
+			value, err := s.decodeValue(v)
+			if err != nil {
+				return corruptValue(bucket, string(k), err)
+			}
+			b.Delete(k)
+			deleteKeyMeta(tx, bucket, k)
+			keystore[string(k)] = value
+			if len(keystore) == n {
+				break
+			}
+		}
+		return nil
+	})
+	return keystore, err
+}
+
+func (s *Server) moveBuckets(dbname string, bucket1 string, bucket2 string, keys []string) error {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return moveKeysInTx(tx, bucket1, bucket2, keys)
+	})
+}
+
+func moveKeysInTx(tx *bolt.Tx, bucket1 string, bucket2 string, keys []string) error {
+	b := resolveBucket(tx, bucket1)
+	if b == nil {
+		return bucketNotFound(bucket1)
+	}
+	b2, err := createBucketPath(tx, bucket2)
+	if err != nil {
+		return err
+	}
+	mb := keyMetaBucket(tx, bucket1)
+	now := time.Now()
+	for _, key := range keys {
+		val := b.Get([]byte(key))
+		m := readKeyMeta(mb, []byte(key))
+		if val == nil || m.expired(now) {
+			return keyNotFound(bucket1, key)
+		}
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if err := b2.Put([]byte(key), val); err == bolt.ErrIncompatibleValue {
+			return incompatibleValue("Can't move key '%s' where there is a bucket", key)
+		} else if err != nil {
+			return err
+		}
+		if err := deleteKeyMeta(tx, bucket1, []byte(key)); err != nil {
+			return err
+		}
+		if err := writeKeyMeta(tx, bucket2, []byte(key), m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) hasKeys(dbname string, buckets []string, keys []string) (doesHaveKeyMap map[string]bool, err error) {
+	doesHaveKeyMap = make(map[string]bool)
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return doesHaveKeyMap, err
+	}
+	defer release()
+
+	for _, key := range keys {
+		doesHaveKeyMap[key] = false
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			b := resolveBucket(tx, bucket)
+			if b == nil {
+				continue
+			}
+			mb := keyMetaBucket(tx, bucket)
+			now := time.Now()
+			for _, key := range keys {
+				v := b.Get([]byte(key))
+				if v != nil && !isExpired(mb, []byte(key), now) {
+					doesHaveKeyMap[string(key)] = true
+				}
+			}
+		}
+		return nil
+	})
+	return doesHaveKeyMap, err
+}
+
+func (s *Server) hasKey(dbname string, bucket string, key string) (doesHaveKey bool, err error) {
+	doesHaveKey = false
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return doesHaveKey, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		v := b.Get([]byte(key))
+		if v != nil && !isExpired(keyMetaBucket(tx, bucket), []byte(key), time.Now()) {
+			doesHaveKey = true
+		}
+		return nil
+	})
+	return doesHaveKey, err
+}
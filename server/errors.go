@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Codes of the errors returned by the API, which clients can rely on
+// instead of the message
+const (
+	codeBadRequest           = "bad_request"
+	codeInvalidName          = "invalid_name"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeDBNotFound           = "db_not_found"
+	codeBucketNotFound       = "bucket_not_found"
+	codeKeyNotFound          = "key_not_found"
+	codeLeaseNotFound        = "lease_not_found"
+	codeConflict             = "conflict"
+	codePreconditionFailed   = "precondition_failed"
+	codeRequestInProgress    = "request_in_progress"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeRequestTooLarge      = "request_too_large"
+	codeShuttingDown         = "shutting_down"
+	codeCorruptValue         = "corrupt_value"
+	codeIncompatibleValue    = "incompatible_value"
+	codeInternal             = "internal"
+)
+
+// apiError is an error with the HTTP status it should be returned with and a
+// stable code that clients can check instead of the message. It is returned
+// as {"code":"...","message":"..."}.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+var errShuttingDown = &apiError{Status: http.StatusServiceUnavailable, Code: codeShuttingDown, Message: "Server is shutting down"}
+
+func badRequest(format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: codeBadRequest, Message: fmt.Sprintf(format, a...)}
+}
+
+func invalidName(format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: codeInvalidName, Message: fmt.Sprintf(format, a...)}
+}
+
+func dbNotFound(dbname string) *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: codeDBNotFound, Message: "Could not find '" + dbname + "'"}
+}
+
+func bucketNotFound(bucket string) *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: codeBucketNotFound, Message: "Bucket '" + bucket + "' does not exist"}
+}
+
+func keyNotFound(bucket string, key string) *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: codeKeyNotFound, Message: "Could not find key '" + key + "' in '" + bucket + "'"}
+}
+
+// corruptValue is returned for a stored value that can't be decoded
+func corruptValue(bucket string, key string, err error) *apiError {
+	return &apiError{Status: http.StatusInternalServerError, Code: codeCorruptValue, Message: "Could not decode key '" + key + "' in '" + bucket + "': " + err.Error()}
+}
+
+// requestTooLarge is returned for a body larger than Config.MaxBodySize
+func requestTooLarge(limit int64) *apiError {
+	return &apiError{Status: http.StatusRequestEntityTooLarge, Code: codeRequestTooLarge, Message: fmt.Sprintf("Request body can't be larger than %d bytes", limit)}
+}
+
+// incompatibleValue is returned for writing a key where there is a nested
+// bucket, or a bucket where there is a key
+func incompatibleValue(format string, a ...interface{}) *apiError {
+	return &apiError{Status: http.StatusConflict, Code: codeIncompatibleValue, Message: fmt.Sprintf(format, a...)}
+}
+
+func preconditionFailed(message string) *apiError {
+	return &apiError{Status: http.StatusPreconditionFailed, Code: codePreconditionFailed, Message: message}
+}
+
+// prefixError adds context to the message of an error, keeping its status
+// and code if it is an *apiError
+func prefixError(prefix string, err error) error {
+	if e, ok := err.(*apiError); ok {
+		return &apiError{Status: e.Status, Code: e.Code, Message: prefix + ": " + e.Message}
+	}
+	return fmt.Errorf("%s: %s", prefix, err.Error())
+}
+
+// respondError stops the request with the status and JSON body of the
+// error. Errors without a status are internal errors, which are added to the
+// errors of the request to be logged.
+func respondError(c *gin.Context, err error) {
+	switch e := err.(type) {
+	case *apiError:
+		c.AbortWithStatusJSON(e.Status, e)
+	case *conflictError:
+		c.AbortWithStatusJSON(e.Status, e)
+	case *preconditionError:
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, preconditionFailed(e.Error()))
+	case *snapshotError:
+		c.AbortWithStatusJSON(http.StatusBadRequest, badRequest("%s", e.Error()))
+	default:
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &apiError{Code: codeInternal, Message: err.Error()})
+	}
+}
+
+// logErrors logs the internal errors of a request after it is handled
+func (s *Server) logErrors(c *gin.Context) {
+	c.Next()
+	for _, err := range c.Errors {
+		s.log.Error("%s %s: %s", c.Request.Method, c.Request.URL.Path, err.Error())
+	}
+}
@@ -0,0 +1,788 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRangeLimit is the page size for range scans that do not specify ?limit
+const defaultRangeLimit = 1000
+
+func (s *Server) handleHasKeys(c *gin.Context) {
+	dbname := c.Param("dbname")
+
+	type QueryJSON struct {
+		Keys    []string `json:"keys"`
+		Buckets []string `json:"buckets"`
+	}
+	var json QueryJSON
+	if c.ShouldBindJSON(&json) != nil {
+		respondError(c, badRequest("Problem binding keys"))
+		return
+	}
+	if err := validateBucketNames(json.Buckets...); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	doesHaveKeyMap, err := s.hasKeys(dbname, json.Buckets, json.Keys)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, doesHaveKeyMap)
+}
+
+func (s *Server) handleCreateDB(c *gin.Context) {
+	dbname := c.Param("dbname")
+
+	var json []string
+	if c.ShouldBindJSON(&json) != nil {
+		respondError(c, badRequest("Problem binding keys"))
+		return
+	}
+	if err := validateBucketNames(json...); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	err := s.createDatabase(dbname, json)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, "Created db")
+}
+
+func (s *Server) handleHasKey(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	key := c.Param("key")
+	doesHaveKey, err := s.hasKey(dbname, bucket, key)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, doesHaveKey)
+}
+
+func (s *Server) handleGetDBStats(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucketNames, err := s.getBucketNames(dbname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	stats := make(map[string]int)
+	for _, bucket := range bucketNames {
+		stats[bucket], err = s.getNumberKeysInBucket(dbname, bucket)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func (s *Server) handleGetNumKeys(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	n, err := s.getNumberKeysInBucket(dbname, bucket)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, n)
+}
+
+func (s *Server) handleGetBuckets(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucketNames, err := s.getBucketNames(dbname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, bucketNames)
+}
+
+func (s *Server) handleGetChildBuckets(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	names, err := s.getChildBuckets(dbname, bucket)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, names)
+}
+
+func (s *Server) handleGetTree(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	tree, err := s.getBucketTree(dbname, bucket)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+func (s *Server) handleDeleteDatabase(c *gin.Context) {
+	dbname := c.Param("dbname")
+	err := s.deleteDatabase(dbname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.String(http.StatusOK, "Deleted database")
+}
+
+func (s *Server) handleBackup(c *gin.Context) {
+	dbname := c.Param("dbname")
+	if !s.databaseExists(dbname) {
+		respondError(c, dbNotFound(dbname))
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", `attachment; filename="`+dbname+`.db"`)
+	err := s.backupDatabase(dbname, c.Writer)
+	if err != nil {
+		s.log.Error("Could not back up %s: %s", dbname, err.Error())
+		if !c.Writer.Written() {
+			respondError(c, err)
+		}
+		return
+	}
+	s.log.Trace("Backed up %s", dbname)
+}
+
+func (s *Server) handleRestore(c *gin.Context) {
+	dbname := c.Param("dbname")
+	err := s.restoreDatabase(dbname, c.Request.Body)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.log.Trace("Restored %s", dbname)
+	c.String(http.StatusOK, "Restored database")
+}
+
+func (s *Server) handleMigrate(c *gin.Context) {
+	dbname := c.Param("dbname")
+	var json struct {
+		Codec     string `json:"codec"`
+		BatchSize int    `json:"batch_size"`
+	}
+	if c.Request.ContentLength != 0 && c.ShouldBindJSON(&json) != nil {
+		respondError(c, badRequest("Problem binding codec and batch_size"))
+		return
+	}
+	status, err := s.Migrate(c.Request.Context(), dbname, MigrateOptions{Codec: json.Codec, BatchSize: json.BatchSize})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.log.Info("Migrated %d values of %s to %s", status.Rewritten, dbname, status.Codec)
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) handleMigration(c *gin.Context) {
+	status, err := s.Migration(c.Param("dbname"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) handleDeleteBucket(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	err := s.deleteBucket(dbname, bucket)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.publish(event{Type: "delete_bucket", DB: dbname, Bucket: bucket})
+	c.String(http.StatusOK, "Deleted bucket")
+}
+
+func (s *Server) handleDeleteKeys(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	var keys []string
+	if c.ShouldBindJSON(&keys) != nil {
+		respondError(c, badRequest("Problem binding keys"))
+		return
+	}
+	err := s.deleteKeys(dbname, bucket, keys)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	events := make([]event, len(keys))
+	for i, key := range keys {
+		events[i] = event{Type: "delete", DB: dbname, Bucket: bucket, Key: key}
+	}
+	s.publish(events...)
+	c.String(http.StatusOK, "Deleted keys")
+}
+
+// updateJSON is the form of an update that sets TTLs or conditions, where
+// TTL applies to every key without its own TTL in TTLs.
+type updateJSON struct {
+	Keystore   map[string]string `json:"keystore"`
+	TTL        string            `json:"ttl"`
+	TTLs       map[string]string `json:"ttls"`
+	IfAbsent   bool              `json:"if_absent"`
+	IfValues   map[string]string `json:"if_values"`
+	IfVersions map[string]uint64 `json:"if_versions"`
+}
+
+// parseTTLs returns the TTL of each key in the keystore that has one
+func (update updateJSON) parseTTLs() (ttls map[string]time.Duration, err error) {
+	ttls = make(map[string]time.Duration)
+	for key := range update.Keystore {
+		ttl, ok := update.TTLs[key]
+		if !ok {
+			ttl = update.TTL
+		}
+		if ttl == "" {
+			continue
+		}
+		ttls[key], err = time.ParseDuration(ttl)
+		if err != nil || ttls[key] <= 0 {
+			return ttls, badRequest("Problem parsing ttl for %s, must be a positive duration like 30s", key)
+		}
+	}
+	return ttls, nil
+}
+
+func (s *Server) handleUpdate(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, badRequest("Problem reading keystore"))
+		return
+	}
+	// The body is either the keystore itself or an updateJSON
+	update := updateJSON{TTL: c.Query("ttl")}
+	var keystore map[string]string
+	if json.Unmarshal(body, &keystore) == nil && keystore != nil {
+		update.Keystore = keystore
+	} else if json.Unmarshal(body, &update) != nil || update.Keystore == nil {
+		respondError(c, badRequest("Problem binding keystore"))
+		return
+	}
+
+	ttls, err := update.parseTTLs()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	conds := writeConditions{
+		IfAbsent:   update.IfAbsent,
+		IfValues:   update.IfValues,
+		IfVersions: update.IfVersions,
+	}
+
+	// If-Match and If-None-Match apply to updates of a single key
+	ifMatch := c.GetHeader("If-Match")
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	var key string
+	if ifMatch != "" || ifNoneMatch != "" {
+		if len(update.Keystore) != 1 {
+			respondError(c, badRequest("If-Match and If-None-Match require a single key"))
+			return
+		}
+		for key = range update.Keystore {
+		}
+	}
+	if err = etagConditions(ifMatch, ifNoneMatch, key, &conds); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	versions, err := s.updateDatabase(dbname, bucket, update.Keystore, ttls, conds)
+	if err != nil {
+		if conflict, ok := err.(*conflictError); ok {
+			if conflict.Exists {
+				c.Header("ETag", formatETag(conflict.Version))
+			}
+			if ifMatch != "" || ifNoneMatch != "" {
+				conflict.Status = http.StatusPreconditionFailed
+				conflict.Code = codePreconditionFailed
+			}
+		}
+		respondError(c, err)
+		return
+	}
+	events := []event{}
+	for key, value := range update.Keystore {
+		events = append(events, event{Type: "put", DB: dbname, Bucket: bucket, Key: key, Value: value})
+	}
+	s.publish(events...)
+	if len(versions) == 1 {
+		for _, version := range versions {
+			c.Header("ETag", formatETag(version))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":  fmt.Sprintf("Inserted %d things into %s", len(update.Keystore), bucket),
+		"versions": versions,
+	})
+}
+
+// etagConditions adds the write conditions of If-Match and If-None-Match
+// headers for a single key
+func etagConditions(ifMatch string, ifNoneMatch string, key string, conds *writeConditions) error {
+	if ifMatch == "*" {
+		conds.IfExists = true
+	} else if ifMatch != "" {
+		version, err := parseETag(ifMatch)
+		if err != nil {
+			return badRequest("%s", err.Error())
+		}
+		conds.IfVersions = map[string]uint64{key: version}
+	}
+	if ifNoneMatch == "*" {
+		conds.IfAbsent = true
+	} else if ifNoneMatch != "" {
+		return badRequest("If-None-Match must be * for updates")
+	}
+	return nil
+}
+
+// rawKey returns the key of a /key/*key route, which can contain slashes
+func rawKey(c *gin.Context) (string, error) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		return key, badRequest("Must provide a key")
+	}
+	return key, nil
+}
+
+func (s *Server) handlePutRaw(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	key, err := rawKey(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	value, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, badRequest("Problem reading value"))
+		return
+	}
+	var ttl time.Duration
+	if query := c.Query("ttl"); query != "" {
+		ttl, err = time.ParseDuration(query)
+		if err != nil || ttl <= 0 {
+			respondError(c, badRequest("Problem parsing ttl, must be a positive duration like 30s"))
+			return
+		}
+	}
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	var conds writeConditions
+	if err = etagConditions(c.GetHeader("If-Match"), c.GetHeader("If-None-Match"), key, &conds); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	version, err := s.putRawKey(dbname, bucket, key, value, contentType, ttl, conds)
+	if err != nil {
+		if conflict, ok := err.(*conflictError); ok {
+			if conflict.Exists {
+				c.Header("ETag", formatETag(conflict.Version))
+			}
+			conflict.Status = http.StatusPreconditionFailed
+			conflict.Code = codePreconditionFailed
+		}
+		respondError(c, err)
+		return
+	}
+	e := event{Type: "put", DB: dbname, Bucket: bucket, Key: key}
+	if utf8.Valid(value) {
+		e.Value = string(value)
+	}
+	s.publish(e)
+	c.Header("ETag", formatETag(version))
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Inserted %s into %s", key, bucket),
+		"version": version,
+	})
+}
+
+func (s *Server) handleGetRaw(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	key, err := rawKey(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	value, m, err := s.getRawKey(dbname, bucket, key)
+	if err != nil {
+		if e, ok := err.(*apiError); ok && e.Code == codeKeyNotFound && c.GetHeader("If-Match") != "" {
+			err = preconditionFailed("'" + key + "' does not exist")
+		}
+		respondError(c, err)
+		return
+	}
+	etag := formatETag(m.Version)
+	c.Header("ETag", etag)
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && !matchETag(ifMatch, etag) {
+		respondError(c, preconditionFailed("'"+key+"' does not match "+ifMatch))
+		return
+	}
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && matchETag(ifNoneMatch, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, m.ContentType, value)
+}
+
+func (s *Server) handleDeleteRaw(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	key, err := rawKey(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err = s.deleteRawKey(dbname, bucket, key); err != nil {
+		respondError(c, err)
+		return
+	}
+	s.publish(event{Type: "delete", DB: dbname, Bucket: bucket, Key: key})
+	c.String(http.StatusOK, "Deleted key")
+}
+
+func (s *Server) handleGetKeys(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	if wantsStream(c) {
+		s.respondStream(c, dbname, bucket, rangeQuery{}, true)
+		return
+	}
+	keystore, err := s.getKeysFromDatabase(dbname, bucket)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, keystore)
+}
+
+func (s *Server) handlePop(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	nQuery := c.DefaultQuery("n", "0")
+	num, err := strconv.Atoi(nQuery)
+	if err != nil || num <= 0 {
+		respondError(c, badRequest("Must specify n > 0"))
+		return
+	}
+	if s.config.MaxPop > 0 && num > s.config.MaxPop {
+		num = s.config.MaxPop
+	}
+	if leaseQuery := c.Query("lease"); leaseQuery != "" {
+		visibility, err := time.ParseDuration(leaseQuery)
+		if err != nil || visibility <= 0 {
+			respondError(c, badRequest("Problem parsing lease, must be a positive duration like 30s"))
+			return
+		}
+		lease, err := s.popLeased(dbname, bucket, num, visibility)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		s.publish(popEvents(dbname, bucket, lease.Keystore)...)
+		c.JSON(http.StatusOK, lease)
+		return
+	}
+	keystore, err := s.pop(dbname, bucket, num)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.publish(popEvents(dbname, bucket, keystore)...)
+	c.JSON(http.StatusOK, keystore)
+}
+
+// popEvents returns the events for keys popped from a bucket
+func popEvents(dbname string, bucket string, keystore map[string]string) []event {
+	events := []event{}
+	for key, value := range keystore {
+		events = append(events, event{Type: "pop", DB: dbname, Bucket: bucket, Key: key, Value: value})
+	}
+	return events
+}
+
+func (s *Server) handleRange(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	q := rangeQuery{
+		Prefix: c.Query("prefix"),
+		Start:  c.Query("start"),
+		End:    c.Query("end"),
+		Token:  c.Query("token"),
+	}
+	// Streams are not held in memory, so they are only limited by ?limit
+	stream := wantsStream(c)
+	if !stream {
+		q.Limit = defaultRangeLimit
+	}
+	if limitQuery := c.Query("limit"); limitQuery != "" {
+		limit, err := strconv.Atoi(limitQuery)
+		if err != nil || limit <= 0 {
+			respondError(c, badRequest("Must specify limit > 0"))
+			return
+		}
+		q.Limit = limit
+	}
+	if !stream && s.config.MaxRangeLimit > 0 && q.Limit > s.config.MaxRangeLimit {
+		q.Limit = s.config.MaxRangeLimit
+	}
+	if reverseQuery := c.Query("reverse"); reverseQuery != "" {
+		reverse, err := strconv.ParseBool(reverseQuery)
+		if err != nil {
+			respondError(c, badRequest("Problem parsing reverse"))
+			return
+		}
+		q.Reverse = reverse
+	}
+	if q.Token != "" {
+		if _, err := decodeRangeToken(q.Token); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	if stream {
+		s.respondStream(c, dbname, bucket, q, false)
+		return
+	}
+	entries, next, err := s.getRangeFromDatabase(dbname, bucket, q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"next":    next,
+	})
+}
+
+// leaseReleaseJSON specifies the keys of a lease to ack or nack, where no
+// keys means every key of the lease
+type leaseReleaseJSON struct {
+	Lease string   `json:"lease"`
+	Keys  []string `json:"keys"`
+}
+
+func (s *Server) handleAck(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	var json leaseReleaseJSON
+	if c.ShouldBindJSON(&json) != nil || json.Lease == "" {
+		respondError(c, badRequest("Must provide lease"))
+		return
+	}
+	n, err := s.ackLease(dbname, bucket, json.Lease, json.Keys)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("Acknowledged %d keys", n))
+}
+
+func (s *Server) handleNack(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	var json leaseReleaseJSON
+	if c.ShouldBindJSON(&json) != nil || json.Lease == "" {
+		respondError(c, badRequest("Must provide lease"))
+		return
+	}
+	n, err := s.nackLease(dbname, bucket, json.Lease, json.Keys)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("Returned %d keys", n))
+}
+
+func (s *Server) handleGet(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	keysQuery := c.DefaultQuery("keys", "")
+	json := []string{}
+	if c.ShouldBindJSON(&json) != nil && keysQuery != "" {
+		json = strings.Split(keysQuery, ",")
+	}
+	// If requested some without providing keys, throw error
+	if len(json) == 0 && strings.Contains(c.Request.RequestURI, "some") {
+		respondError(c, badRequest("Must provide keys"))
+		return
+	}
+	if len(json) == 0 && wantsStream(c) {
+		s.respondStream(c, dbname, bucket, rangeQuery{}, false)
+		return
+	}
+	// Get keys and values
+	keystore, versions, err := s.getFromDatabase(dbname, bucket, json)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	// Reads of a single key have an ETag of its version
+	if len(json) == 1 {
+		ifMatch := c.GetHeader("If-Match")
+		version, ok := versions[json[0]]
+		if !ok {
+			if ifMatch != "" {
+				respondError(c, preconditionFailed("'"+json[0]+"' does not exist"))
+				return
+			}
+		} else {
+			etag := formatETag(version)
+			c.Header("ETag", etag)
+			if ifMatch != "" && !matchETag(ifMatch, etag) {
+				respondError(c, preconditionFailed("'"+json[0]+"' does not match "+ifMatch))
+				return
+			}
+			if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && matchETag(ifNoneMatch, etag) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	c.JSON(http.StatusOK, keystore)
+	return
+}
+
+func (s *Server) handleGetVersions(c *gin.Context) {
+	dbname := c.Param("dbname")
+	bucket := c.Param("bucket")
+	keysQuery := c.DefaultQuery("keys", "")
+	json := []string{}
+	if c.ShouldBindJSON(&json) != nil && keysQuery != "" {
+		json = strings.Split(keysQuery, ",")
+	}
+	_, versions, err := s.getFromDatabase(dbname, bucket, json)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+func (s *Server) handleMove(c *gin.Context) {
+	dbname := c.Param("dbname")
+	type QueryJSON struct {
+		FromBucket string   `json:"from_bucket"`
+		ToBucket   string   `json:"to_bucket"`
+		Keys       []string `json:"keys"`
+	}
+	var json QueryJSON
+	if c.ShouldBindJSON(&json) != nil {
+		respondError(c, badRequest("Must provide keys, from_bucket and to_bucket"))
+		return
+	}
+	if err := validateBucketNames(json.FromBucket, json.ToBucket); err != nil {
+		respondError(c, err)
+		return
+	}
+	// Get keys and values
+	err := s.moveBuckets(dbname, json.FromBucket, json.ToBucket, json.Keys)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.log.Trace("Moved %v from %s to %s", json.Keys, json.FromBucket, json.ToBucket)
+	events := make([]event, len(json.Keys))
+	for i, key := range json.Keys {
+		events[i] = event{Type: "move", DB: dbname, Bucket: json.FromBucket, Key: key, ToBucket: json.ToBucket}
+	}
+	s.publish(events...)
+	c.JSON(http.StatusOK, fmt.Sprintf("Moved keys"))
+}
+
+func (s *Server) handleTransaction(c *gin.Context) {
+	dbname := c.Param("dbname")
+	var t txJSON
+	if c.ShouldBindJSON(&t) != nil {
+		respondError(c, badRequest("Must provide ops and preconditions"))
+		return
+	}
+	if err := t.validate(); err != nil {
+		respondError(c, err)
+		return
+	}
+	for _, op := range t.Ops {
+		if op.Op == "delete_bucket" && !s.hasAccess(c, "", adminAccess) {
+			respondError(c, &apiError{Status: http.StatusForbidden, Code: codeForbidden, Message: "Requires admin access to delete buckets"})
+			return
+		}
+	}
+	err := s.runTransaction(dbname, t)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.log.Trace("Applied %d ops to %s", len(t.Ops), dbname)
+	s.publish(t.events(dbname)...)
+	c.String(http.StatusOK, fmt.Sprintf("Applied %d ops", len(t.Ops)))
+}
+
+func (s *Server) handleWatch(c *gin.Context) {
+	dbname := c.Param("dbname")
+	w := s.addWatcher(dbname, c.Query("bucket"), c.Query("prefix"))
+	defer s.removeWatcher(w)
+
+	// Send a comment periodically so idle connections are kept open
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	// Send the headers now so the client knows it is watching
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(out io.Writer) bool {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				if s.closed() {
+					c.SSEvent("shutdown", "Server is shutting down, reconnect to continue watching")
+				} else {
+					c.SSEvent("overflow", "Fell too far behind, reconnect to continue watching")
+				}
+				return false
+			}
+			c.SSEvent(e.Type, e)
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(out, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxIdempotencyKeyLength limits the keys that clients can send
+const maxIdempotencyKeyLength = 255
+
+// idempotentResponse is the response to a request with an Idempotency-Key,
+// which is done once the request has been handled
+type idempotentResponse struct {
+	id          string
+	fingerprint string
+	done        bool
+	expires     time.Time
+	elem        *list.Element
+	size        int64 // bytes kept once it is done
+
+	status      int
+	contentType string
+	etag        string
+	body        []byte
+}
+
+// recordingWriter keeps a copy of the body written to the response
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent is middleware for writes that replays the response to the first
+// request with an Idempotency-Key header to retries with the same key, so
+// that retried writes like pops and moves are only applied once. Responses
+// to requests that failed with a server error are not kept, so they can be
+// retried. Responses are kept for Config.IdempotencyTTL, but the oldest are
+// dropped to keep them under Config.IdempotencyMaxBytes, and a response
+// larger than that is not kept at all.
+func (s *Server) idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		respondError(c, badRequest("Idempotency-Key can't be longer than %d characters", maxIdempotencyKeyLength))
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondError(c, requestTooLarge(tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		respondError(c, badRequest("Problem reading body"))
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Keys are scoped to the user and database of the request, and a key can
+	// only be used for one request
+	scope := sha256.Sum256([]byte(c.GetString("user")))
+	id := hex.EncodeToString(scope[:]) + "/" + c.Param("dbname") + "/" + key
+	fingerprint := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.RequestURI()+"\n"), body...))
+
+	now := time.Now()
+	s.idempotentResponses.Lock()
+	r, ok := s.idempotentResponses.data[id]
+	if ok && now.After(r.expires) {
+		s.forgetIdempotentResponse(r)
+		ok = false
+	}
+	if ok {
+		s.idempotentResponses.Unlock()
+		switch {
+		case r.fingerprint != hex.EncodeToString(fingerprint[:]):
+			respondError(c, &apiError{Status: http.StatusUnprocessableEntity, Code: codeIdempotencyKeyReused, Message: "Idempotency-Key '" + key + "' was used for a different request"})
+		case !r.done:
+			respondError(c, &apiError{Status: http.StatusConflict, Code: codeRequestInProgress, Message: "A request with Idempotency-Key '" + key + "' is in progress"})
+		default:
+			s.log.Trace("Replaying response for Idempotency-Key %s", key)
+			if r.etag != "" {
+				c.Header("ETag", r.etag)
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(r.status, r.contentType, r.body)
+			c.Abort()
+		}
+		return
+	}
+	r = &idempotentResponse{id: id, fingerprint: hex.EncodeToString(fingerprint[:]), expires: now.Add(s.config.IdempotencyTTL)}
+	r.elem = s.idempotentResponses.order.PushBack(r)
+	s.idempotentResponses.data[id] = r
+	s.idempotentResponses.Unlock()
+
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	handled := false
+	defer func() {
+		s.idempotentResponses.Lock()
+		defer s.idempotentResponses.Unlock()
+		if s.idempotentResponses.data[id] != r {
+			// It expired while the request was being handled
+			return
+		}
+		if !handled || w.Status() >= http.StatusInternalServerError {
+			s.forgetIdempotentResponse(r)
+			return
+		}
+		r.done = true
+		r.status = w.Status()
+		r.contentType = w.Header().Get("Content-Type")
+		r.etag = w.Header().Get("ETag")
+		r.body = w.body.Bytes()
+		r.size = int64(len(r.id) + len(r.contentType) + len(r.etag) + len(r.body))
+		if r.size > s.config.IdempotencyMaxBytes {
+			s.log.Debug("Not keeping the response for Idempotency-Key %s, which is %d bytes", key, r.size)
+			s.forgetIdempotentResponse(r)
+			return
+		}
+		s.idempotentResponses.bytes += r.size
+		// Drop the oldest responses, but not those of requests in progress
+		for e := s.idempotentResponses.order.Front(); e != nil && s.idempotentResponses.bytes > s.config.IdempotencyMaxBytes; {
+			oldest := e.Value.(*idempotentResponse)
+			e = e.Next()
+			if oldest.done {
+				s.forgetIdempotentResponse(oldest)
+			}
+		}
+	}()
+	c.Next()
+	handled = true
+}
+
+// forgetIdempotentResponse removes a response if it has not been removed
+// already. s.idempotentResponses must be locked.
+func (s *Server) forgetIdempotentResponse(r *idempotentResponse) {
+	if s.idempotentResponses.data[r.id] != r {
+		return
+	}
+	delete(s.idempotentResponses.data, r.id)
+	s.idempotentResponses.order.Remove(r.elem)
+	if r.done {
+		s.idempotentResponses.bytes -= r.size
+	}
+}
+
+// forgetIdempotentResponses removes the responses whose keys have expired,
+// which are the oldest since every key has the same TTL
+func (s *Server) forgetIdempotentResponses() (n int) {
+	now := time.Now()
+	s.idempotentResponses.Lock()
+	defer s.idempotentResponses.Unlock()
+	for e := s.idempotentResponses.order.Front(); e != nil; {
+		r := e.Value.(*idempotentResponse)
+		if !now.After(r.expires) {
+			break
+		}
+		e = e.Next()
+		s.forgetIdempotentResponse(r)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// leasesBucketName is the bucket holding a sub-bucket for each lease, which
+// has the lease info and the items that were popped under the lease
+const leasesBucketName = "__leases"
+
+// leaseInfo is stored under the "info" key of a lease
+type leaseInfo struct {
+	Bucket  string `json:"bucket"`
+	Expires int64  `json:"expires"` // unix nanoseconds
+}
+
+// leasedItem is stored under its key in the "items" bucket of a lease
+type leasedItem struct {
+	Value []byte  `json:"value"`
+	Meta  keyMeta `json:"meta"`
+}
+
+// leaseJSON is the result of a leased pop
+type leaseJSON struct {
+	Lease    string            `json:"lease"`
+	Expires  time.Time         `json:"expires"`
+	Keystore map[string]string `json:"keystore"`
+}
+
+// errLeaseNotFound is returned when acknowledging a lease that does not
+// exist, because it was already acknowledged or it expired and was redelivered
+var errLeaseNotFound = &apiError{Status: http.StatusNotFound, Code: codeLeaseNotFound, Message: "Lease does not exist"}
+
+// newLeaseID returns a random lease ID. Lease IDs are all that ack and nack
+// check, so they must not be predictable.
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// popLeased removes the first n keys from a bucket and holds them under a
+// new lease. They are returned to the bucket if the lease is not
+// acknowledged before the visibility timeout.
+func (s *Server) popLeased(dbname string, bucket string, n int, visibility time.Duration) (lease leaseJSON, err error) {
+	lease.Keystore = make(map[string]string)
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return lease, err
+	}
+	defer release()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if _, err := redeliverLeasesInTx(tx, now); err != nil {
+			return err
+		}
+
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+
+		mb := keyMetaBucket(tx, bucket)
+		items := make(map[string]leasedItem)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && len(items) < n; k, v = c.Next() {
+			if v == nil {
+				continue
+			}
+			m := readKeyMeta(mb, k)
+			if m.expired(now) {
+				continue
+			}
+			items[string(k)] = leasedItem{Value: append([]byte{}, v...), Meta: m}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		leases, err := tx.CreateBucketIfNotExists([]byte(leasesBucketName))
+		if err != nil {
+			return err
+		}
+		lease.Lease, err = newLeaseID()
+		if err != nil {
+			return err
+		}
+		lb, err := leases.CreateBucket([]byte(lease.Lease))
+		if err != nil {
+			return err
+		}
+		lease.Expires = now.Add(visibility)
+		info, err := json.Marshal(leaseInfo{Bucket: bucket, Expires: lease.Expires.UnixNano()})
+		if err != nil {
+			return err
+		}
+		if err = lb.Put([]byte("info"), info); err != nil {
+			return err
+		}
+		ib, err := lb.CreateBucket([]byte("items"))
+		if err != nil {
+			return err
+		}
+
+		for key, item := range items {
+			v, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err = ib.Put([]byte(key), v); err != nil {
+				return err
+			}
+			if err = b.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err = deleteKeyMeta(tx, bucket, []byte(key)); err != nil {
+				return err
+			}
+			value, err := s.decodeValue(item.Value)
+			if err != nil {
+				return corruptValue(bucket, key, err)
+			}
+			lease.Keystore[key] = value
+		}
+		return nil
+	})
+	return lease, err
+}
+
+// getLeaseInTx returns the bucket and info of a lease on a bucket
+func getLeaseInTx(tx *bolt.Tx, bucket string, leaseID string) (*bolt.Bucket, leaseInfo, error) {
+	var info leaseInfo
+	leases := tx.Bucket([]byte(leasesBucketName))
+	if leases == nil || leaseID == "" {
+		return nil, info, errLeaseNotFound
+	}
+	lb := leases.Bucket([]byte(leaseID))
+	if lb == nil {
+		return nil, info, errLeaseNotFound
+	}
+	if err := json.Unmarshal(lb.Get([]byte("info")), &info); err != nil {
+		return nil, info, err
+	}
+	if info.Bucket != bucket {
+		return nil, info, errLeaseNotFound
+	}
+	return lb, info, nil
+}
+
+// releaseLeaseInTx removes the keys from a lease, or every key if none are
+// specified, putting them back in the bucket if redeliver is set. The lease
+// is removed once it has no keys left.
+func releaseLeaseInTx(tx *bolt.Tx, leaseID string, lb *bolt.Bucket, info leaseInfo, keys []string, redeliver bool) (n int, err error) {
+	ib := lb.Bucket([]byte("items"))
+	if len(keys) == 0 {
+		ib.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}
+
+	for _, key := range keys {
+		v := ib.Get([]byte(key))
+		if v == nil {
+			continue
+		}
+		if redeliver {
+			var item leasedItem
+			if err = json.Unmarshal(v, &item); err != nil {
+				return n, err
+			}
+			if err = redeliverInTx(tx, info.Bucket, key, item); err != nil {
+				return n, err
+			}
+		}
+		if err = ib.Delete([]byte(key)); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	if k, _ := ib.Cursor().First(); k == nil {
+		err = tx.Bucket([]byte(leasesBucketName)).DeleteBucket([]byte(leaseID))
+	}
+	return n, err
+}
+
+// redeliverInTx puts a leased item back into its bucket, unless the key was
+// written again while it was leased
+func redeliverInTx(tx *bolt.Tx, bucket string, key string, item leasedItem) error {
+	b, err := createBucketPath(tx, bucket)
+	if err != nil {
+		return err
+	}
+	if b.Get([]byte(key)) != nil {
+		return nil
+	}
+	if err = b.Put([]byte(key), item.Value); err != nil {
+		return err
+	}
+	return writeKeyMeta(tx, bucket, []byte(key), item.Meta)
+}
+
+// redeliverLeasesInTx puts the items of every expired lease back into their
+// buckets, returning the number of items redelivered
+func redeliverLeasesInTx(tx *bolt.Tx, now time.Time) (n int, err error) {
+	leases := tx.Bucket([]byte(leasesBucketName))
+	if leases == nil {
+		return 0, nil
+	}
+
+	expired := []string{}
+	leases.ForEach(func(leaseID, _ []byte) error {
+		var info leaseInfo
+		lb := leases.Bucket(leaseID)
+		if lb != nil && json.Unmarshal(lb.Get([]byte("info")), &info) == nil && info.Expires <= now.UnixNano() {
+			expired = append(expired, string(leaseID))
+		}
+		return nil
+	})
+
+	for _, leaseID := range expired {
+		lb := leases.Bucket([]byte(leaseID))
+		var info leaseInfo
+		if err = json.Unmarshal(lb.Get([]byte("info")), &info); err != nil {
+			return n, err
+		}
+		released, err := releaseLeaseInTx(tx, leaseID, lb, info, nil, true)
+		n += released
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// redeliverExpiredLeases puts the items of every expired lease back into
+// their buckets, returning the number of items redelivered
+func redeliverExpiredLeases(db *bolt.DB) (n int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		n, err = redeliverLeasesInTx(tx, time.Now())
+		return err
+	})
+	return n, err
+}
+
+// ackLease deletes the keys of a lease, or every key if none are specified,
+// so that they are not redelivered
+func (s *Server) ackLease(dbname string, bucket string, leaseID string, keys []string) (n int, err error) {
+	return s.releaseLease(dbname, bucket, leaseID, keys, false)
+}
+
+// nackLease puts the keys of a lease, or every key if none are specified,
+// back into the bucket immediately
+func (s *Server) nackLease(dbname string, bucket string, leaseID string, keys []string) (n int, err error) {
+	return s.releaseLease(dbname, bucket, leaseID, keys, true)
+}
+
+func (s *Server) releaseLease(dbname string, bucket string, leaseID string, keys []string, redeliver bool) (n int, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return n, err
+	}
+	defer release()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Leases that have expired can no longer be acknowledged
+		if _, err := redeliverLeasesInTx(tx, time.Now()); err != nil {
+			return err
+		}
+		lb, info, err := getLeaseInTx(tx, bucket, leaseID)
+		if err != nil {
+			return err
+		}
+		n, err = releaseLeaseInTx(tx, leaseID, lb, info, keys, redeliver)
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets beginning with reservedBucketPrefix are used by the server and are
+// hidden from clients.
+const reservedBucketPrefix = "__"
+
+// metaBucketName is the bucket holding a sub-bucket of key metadata for each
+// bucket that has keys with metadata.
+const metaBucketName = "__meta"
+
+// keyMeta is the metadata stored alongside a value
+type keyMeta struct {
+	Expires     int64  `json:"expires,omitempty"` // unix nanoseconds
+	Version     uint64 `json:"version,omitempty"`
+	ContentType string `json:"content_type,omitempty"` // of values written with PUT /key
+}
+
+// isReservedBucket returns whether the bucket is used internally by the server
+func isReservedBucket(bucket string) bool {
+	return strings.HasPrefix(bucket, reservedBucketPrefix)
+}
+
+// expired returns whether the key has a TTL that has passed
+func (m keyMeta) expired(now time.Time) bool {
+	return m.Expires != 0 && m.Expires <= now.UnixNano()
+}
+
+// keyMetaBucket returns the bucket of key metadata for bucket, or nil if none
+// of its keys have metadata.
+func keyMetaBucket(tx *bolt.Tx, bucket string) *bolt.Bucket {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	return meta.Bucket([]byte(bucket))
+}
+
+// readKeyMeta returns the metadata for key from the bucket returned by
+// keyMetaBucket, which may be nil.
+func readKeyMeta(mb *bolt.Bucket, key []byte) (m keyMeta) {
+	if mb == nil {
+		return
+	}
+	v := mb.Get(key)
+	if v == nil {
+		return
+	}
+	json.Unmarshal(v, &m)
+	return
+}
+
+// isExpired returns whether key in the bucket returned by keyMetaBucket has expired
+func isExpired(mb *bolt.Bucket, key []byte, now time.Time) bool {
+	return readKeyMeta(mb, key).expired(now)
+}
+
+// nextVersion returns a new version number, which increases with every write
+// to the database
+func nextVersion(tx *bolt.Tx) (uint64, error) {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return 0, err
+	}
+	return meta.NextSequence()
+}
+
+// writeKeyMeta stores the metadata for a key, removing it if it is empty
+func writeKeyMeta(tx *bolt.Tx, bucket string, key []byte, m keyMeta) error {
+	if m == (keyMeta{}) {
+		return deleteKeyMeta(tx, bucket, key)
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	mb, err := meta.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return mb.Put(key, v)
+}
+
+// deleteKeyMeta removes any metadata stored for a key
+func deleteKeyMeta(tx *bolt.Tx, bucket string, key []byte) error {
+	mb := keyMetaBucket(tx, bucket)
+	if mb == nil {
+		return nil
+	}
+	return mb.Delete(key)
+}
+
+// deleteBucketMeta removes the metadata for every key in a bucket and in the
+// buckets nested in it
+func deleteBucketMeta(tx *bolt.Tx, bucket string) error {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return nil
+	}
+	var names [][]byte
+	meta.ForEach(func(name, v []byte) error {
+		if v == nil && inBucket(string(name), bucket) {
+			names = append(names, append([]byte{}, name...))
+		}
+		return nil
+	})
+	for _, name := range names {
+		if err := meta.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteExpiredKeys removes every key whose TTL has passed, returning the
+// number of keys removed.
+func deleteExpiredKeys(db *bolt.DB) (n int, err error) {
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+		if meta == nil {
+			return nil
+		}
+
+		buckets := []string{}
+		meta.ForEach(func(name, _ []byte) error {
+			buckets = append(buckets, string(name))
+			return nil
+		})
+
+		for _, bucket := range buckets {
+			b := resolveBucket(tx, bucket)
+			if b == nil {
+				// Bucket no longer exists, so neither does its metadata
+				if err := meta.DeleteBucket([]byte(bucket)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			mb := meta.Bucket([]byte(bucket))
+			expiredKeys := [][]byte{}
+			mb.ForEach(func(k, v []byte) error {
+				var m keyMeta
+				if json.Unmarshal(v, &m) == nil && m.expired(now) {
+					expiredKeys = append(expiredKeys, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, key := range expiredKeys {
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+				if err := mb.Delete(key); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// migrateBucketName is the bucket holding the progress of the last migration
+// of a database, so that an interrupted migration resumes where it stopped
+const migrateBucketName = "__migrate"
+
+// defaultMigrateBatchSize is how many values are re-encoded in each
+// transaction of a migration
+const defaultMigrateBatchSize = 1000
+
+// MigrateOptions are how Migrate re-encodes the values of a database
+type MigrateOptions struct {
+	Codec     string                // none, flate, gzip, zstd or snappy, or the codec of the server if empty
+	BatchSize int                   // values read in each transaction, 1000 if 0
+	Progress  func(MigrationStatus) // called after each transaction, if not nil
+}
+
+// MigrationStatus is the progress of migrating the values of a database to a
+// codec
+type MigrationStatus struct {
+	Codec     string `json:"codec"`
+	Bucket    string `json:"bucket,omitempty"` // bucket being migrated
+	Key       string `json:"key,omitempty"`    // last key migrated in the bucket
+	Scanned   int    `json:"scanned"`          // values read
+	Rewritten int    `json:"rewritten"`        // values written with the codec
+	Done      bool   `json:"done"`
+}
+
+// Migrate re-encodes every value of a database with a codec, while the
+// database keeps serving requests. The values are read in transactions of
+// at most BatchSize values, after each of which the progress is saved in the
+// database, so a migration that is interrupted, by ctx or by the server
+// closing, resumes where it stopped when it is run again with the same
+// codec. Values written during the migration use the codec of the server.
+func (s *Server) Migrate(ctx context.Context, dbname string, options MigrateOptions) (status MigrationStatus, err error) {
+	target := s.codec
+	if options.Codec != "" {
+		var ok bool
+		if target, ok = codecs[options.Codec]; !ok {
+			return status, badRequest("Unknown codec '%s', must be none, flate, gzip, zstd or snappy", options.Codec)
+		}
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultMigrateBatchSize
+	}
+
+	s.migrations.Lock()
+	if s.migrations.data[dbname] {
+		s.migrations.Unlock()
+		return status, &apiError{Status: http.StatusConflict, Code: codeRequestInProgress, Message: "'" + dbname + "' is already being migrated"}
+	}
+	s.migrations.data[dbname] = true
+	s.migrations.Unlock()
+	defer func() {
+		s.migrations.Lock()
+		delete(s.migrations.data, dbname)
+		s.migrations.Unlock()
+	}()
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return status, err
+	}
+	defer release()
+
+	name := codecName(target)
+	for {
+		if err = ctx.Err(); err != nil {
+			return status, err
+		}
+		if s.closed() {
+			return status, errShuttingDown
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			status = readMigrationStatus(tx)
+			if status.Codec != name || status.Done {
+				status = MigrationStatus{Codec: name}
+			}
+			if err := s.migrateBatch(tx, target, &status, options.BatchSize); err != nil {
+				return err
+			}
+			return writeMigrationStatus(tx, status)
+		})
+		if err != nil {
+			return status, err
+		}
+		s.log.Debug("Migrated %d of %d values of %s to %s", status.Rewritten, status.Scanned, dbname, name)
+		if options.Progress != nil {
+			options.Progress(status)
+		}
+		if status.Done {
+			return status, nil
+		}
+	}
+}
+
+// migrateBatch re-encodes up to n values after the position of the status,
+// moving on to the next buckets, and marks the status done once there are
+// no values left
+func (s *Server) migrateBatch(tx *bolt.Tx, target codec, status *MigrationStatus, n int) error {
+	var buckets []string
+	for _, path := range bucketPaths(tx) {
+		if path >= status.Bucket {
+			buckets = append(buckets, path)
+		}
+	}
+
+	type rewrite struct{ key, value []byte }
+	for _, bucket := range buckets {
+		if bucket != status.Bucket {
+			status.Bucket, status.Key = bucket, ""
+		}
+		b := resolveBucket(tx, bucket)
+		var rewrites []rewrite
+		c := b.Cursor()
+		k, v := c.First()
+		if status.Key != "" {
+			k, v = c.Seek([]byte(status.Key))
+			if k != nil && bytes.Equal(k, []byte(status.Key)) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && n > 0; k, v = c.Next() {
+			status.Key = string(k)
+			if v == nil {
+				// Skip nested buckets
+				continue
+			}
+			n--
+			status.Scanned++
+			value, err := s.decodeValue(v)
+			if err != nil {
+				return corruptValue(bucket, string(k), err)
+			}
+			if encoded := s.encodeValueWith(target, value); !bytes.Equal(encoded, v) {
+				rewrites = append(rewrites, rewrite{append([]byte{}, k...), encoded})
+			}
+		}
+		// Values are written after reading, since writing moves the cursor
+		for _, r := range rewrites {
+			if err := b.Put(r.key, r.value); err != nil {
+				return err
+			}
+		}
+		status.Rewritten += len(rewrites)
+		if n == 0 {
+			return nil
+		}
+	}
+	status.Bucket, status.Key, status.Done = "", "", true
+	return nil
+}
+
+// readMigrationStatus returns the status of the last migration, which is
+// empty if there hasn't been one
+func readMigrationStatus(tx *bolt.Tx) (status MigrationStatus) {
+	if mb := tx.Bucket([]byte(migrateBucketName)); mb != nil {
+		json.Unmarshal(mb.Get([]byte("status")), &status)
+	}
+	return status
+}
+
+func writeMigrationStatus(tx *bolt.Tx, status MigrationStatus) error {
+	mb, err := tx.CreateBucketIfNotExists([]byte(migrateBucketName))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return mb.Put([]byte("status"), b)
+}
+
+// Migration returns the status of the last migration of a database, which
+// is saved after each transaction of a migration that is running
+func (s *Server) Migration(dbname string) (status MigrationStatus, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return status, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		status = readMigrationStatus(tx)
+		return nil
+	})
+	return status, err
+}
+
+// codecName returns the name of a codec in Config.Codec
+func codecName(c codec) string {
+	for name, candidate := range codecs {
+		if candidate == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("%#x", byte(c))
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+// maxDBNameLength leaves room for the .db extension and the suffix of
+// temporary restore files within common file name limits
+const maxDBNameLength = 200
+
+// reservedDBNames are device names on Windows, which can't be used as files
+var reservedDBNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// validateDBName returns an error if the name can't be used as a database,
+// which may only have letters, digits, '_', '-' and '.' and can't start with
+// '.' or the reserved prefix
+func validateDBName(dbname string) error {
+	if dbname == "" {
+		return invalidName("Database name can't be empty")
+	}
+	if len(dbname) > maxDBNameLength {
+		return invalidName("Database name can't be longer than %d characters", maxDBNameLength)
+	}
+	for _, r := range dbname {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return invalidName("Database name '%s' has invalid character %q", dbname, r)
+		}
+	}
+	if strings.HasPrefix(dbname, ".") {
+		return invalidName("Database name '%s' can't start with '.'", dbname)
+	}
+	if strings.HasPrefix(dbname, reservedBucketPrefix) || reservedDBNames[strings.ToLower(strings.SplitN(dbname, ".", 2)[0])] {
+		return invalidName("Database name '%s' is reserved", dbname)
+	}
+	return nil
+}
+
+// validateBucketName returns an error if the name can't be used as a bucket,
+// which must not be empty or use the reserved prefix of internal buckets.
+// Names of nested buckets are paths like users/2024/active, where every
+// bucket of the path must be a valid name.
+func validateBucketName(bucket string) error {
+	if bucket == "" {
+		return invalidName("Bucket name can't be empty")
+	}
+	if len(bucket) > bolt.MaxKeySize {
+		return invalidName("Bucket name can't be longer than %d bytes", bolt.MaxKeySize)
+	}
+	for _, name := range strings.Split(bucket, bucketSeparator) {
+		if name == "" {
+			return invalidName("Bucket path '%s' has an empty bucket name", bucket)
+		}
+		if isReservedBucket(name) {
+			return invalidName("Bucket name '%s' is reserved", name)
+		}
+	}
+	return nil
+}
+
+// validateBucketNames returns the error of the first invalid bucket name
+func validateBucketNames(buckets ...string) error {
+	for _, bucket := range buckets {
+		if err := validateBucketName(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbFilename returns the file of a database, making sure that it is inside
+// the database directory
+func (s *Server) dbFilename(dbname string) (string, error) {
+	if err := validateDBName(dbname); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(s.dbpath, dbname+".db")
+	if filepath.Dir(filename) != s.dbpath {
+		return "", invalidName("Database name '%s' is outside of the database directory", dbname)
+	}
+	return filename, nil
+}
+
+// checkNames rejects requests whose database or bucket in the route is not
+// a valid name, before they reach the handler
+func (s *Server) checkNames(c *gin.Context) {
+	if dbname := c.Param("dbname"); dbname != "" {
+		if err := validateDBName(dbname); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	if bucket, ok := c.Params.Get("bucket"); ok {
+		if err := validateBucketName(bucket); err != nil {
+			respondError(c, err)
+		}
+	}
+}
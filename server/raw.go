@@ -0,0 +1,90 @@
+package server
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// defaultContentType is the content type of values that were written without
+// one, which are returned by GET /key as they are stored
+const defaultContentType = "application/octet-stream"
+
+// putRawKey writes a value of any bytes with its content type and returns its
+// new version
+func (s *Server) putRawKey(dbname string, bucket string, key string, value []byte, contentType string, ttl time.Duration, conds writeConditions) (version uint64, err error) {
+	db, release, err := s.getDB(dbname)
+	if err != nil {
+		return version, err
+	}
+	defer release()
+
+	keystore := map[string]string{key: string(value)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		err := s.checkWriteConditions(tx, bucket, keystore, conds)
+		if err != nil {
+			return err
+		}
+		versions, err := s.putKeysInTx(tx, bucket, keystore, map[string]time.Duration{key: ttl})
+		if err != nil {
+			return err
+		}
+		version = versions[key]
+		m := readKeyMeta(keyMetaBucket(tx, bucket), []byte(key))
+		m.ContentType = contentType
+		return writeKeyMeta(tx, bucket, []byte(key), m)
+	})
+	return version, err
+}
+
+// getRawKey returns the bytes of a value and its metadata
+func (s *Server) getRawKey(dbname string, bucket string, key string) (value []byte, m keyMeta, err error) {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return value, m, err
+	}
+	defer release()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		m = readKeyMeta(keyMetaBucket(tx, bucket), []byte(key))
+		v := b.Get([]byte(key))
+		if v == nil || m.expired(time.Now()) {
+			return keyNotFound(bucket, key)
+		}
+		decoded, err := s.decodeValue(v)
+		if err != nil {
+			return corruptValue(bucket, key, err)
+		}
+		value = []byte(decoded)
+		return nil
+	})
+	if m.ContentType == "" {
+		m.ContentType = defaultContentType
+	}
+	return value, m, err
+}
+
+// deleteRawKey deletes a key, returning a key_not_found error if it doesn't
+// exist
+func (s *Server) deleteRawKey(dbname string, bucket string, key string) error {
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := resolveBucket(tx, bucket)
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		if b.Get([]byte(key)) == nil || isExpired(keyMetaBucket(tx, bucket), []byte(key), time.Now()) {
+			return keyNotFound(bucket, key)
+		}
+		return deleteKeysInTx(tx, bucket, []string{key})
+	})
+}
@@ -0,0 +1,492 @@
+// Package server is the HTTP API of boltdb-server, which can be run by the
+// boltdb-server command or served from other programs and tests.
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jcelliott/lumber"
+)
+
+// Config is where the server keeps its databases and how it serves them
+type Config struct {
+	DBPath   string // directory of the database files, which is created if needed
+	Compress bool   // compress new values with flate, unless Codec is set
+	Debug    bool   // log at trace level, overriding LogLevel
+	AuthFile string // JSON file of users, API keys and their grants, or empty for no auth
+
+	Codec           string // compression of new values: none, flate, gzip, zstd or snappy
+	CompressMinSize int    // values smaller than this many bytes are not compressed
+
+	IdleTimeout     time.Duration // close databases that have not been used for this long, 10s if 0
+	MaxOpen         int           // most databases kept open, closing the least recently used, or 0 for no limit
+	PinnedDBs       []string      // databases that stay open once they are opened
+	SweepInterval   time.Duration // how often expired keys and leases are swept, 10s if 0
+	NoSync          bool          // don't fsync after each write, which is faster but can lose writes in a crash
+	OpenTimeout     time.Duration // how long to wait for the lock on a database file, 1s if 0
+	InitialMmapSize int           // initial size in bytes of the memory map of each database
+
+	MaxBodySize   int64 // largest request body in bytes, other than restores, or 0 for no limit
+	MaxPop        int   // most keys returned by a pop, or 0 for no limit
+	MaxRangeLimit int   // largest page of a range scan that is not streamed, or 0 for no limit
+
+	IdempotencyTTL      time.Duration // how long responses to requests with an Idempotency-Key are replayed, 24h if 0
+	IdempotencyMaxBytes int64         // most bytes of responses kept for replays, dropping the oldest, 64 MiB if 0
+
+	LogLevel    string // trace, debug, info, warn or error, or warn if empty
+	LogRequests bool   // log every request
+}
+
+const (
+	defaultIdleTimeout   = 10 * time.Second // how long databases stay open without being used
+	defaultSweepInterval = 10 * time.Second // how often expired keys and leases are swept
+	defaultOpenTimeout   = 1 * time.Second  // how long to wait for another process to unlock a database file
+
+	defaultIdempotencyTTL      = 24 * time.Hour // how long responses are replayed
+	defaultIdempotencyMaxBytes = 64 << 20       // most bytes of responses kept for replays
+)
+
+// logLevels are the values of Config.LogLevel
+var logLevels = map[string]int{
+	"trace": lumber.TRACE,
+	"debug": lumber.DEBUG,
+	"info":  lumber.INFO,
+	"warn":  lumber.WARN,
+	"error": lumber.ERROR,
+}
+
+// Validate returns an error if the config has invalid values
+func (config Config) Validate() error {
+	if config.DBPath == "" {
+		return errors.New("Database path can't be empty")
+	}
+	if config.IdleTimeout < 0 || config.OpenTimeout < 0 || config.SweepInterval < 0 || config.IdempotencyTTL < 0 {
+		return errors.New("Timeouts can't be negative")
+	}
+	if _, ok := codecs[config.Codec]; !ok && config.Codec != "" {
+		return fmt.Errorf("Unknown codec '%s', must be none, flate, gzip, zstd or snappy", config.Codec)
+	}
+	if config.CompressMinSize < 0 || config.InitialMmapSize < 0 || config.MaxOpen < 0 || config.MaxBodySize < 0 || config.MaxPop < 0 || config.MaxRangeLimit < 0 || config.IdempotencyMaxBytes < 0 {
+		return errors.New("Sizes and limits can't be negative")
+	}
+	if config.MaxOpen > 0 && len(config.PinnedDBs) > config.MaxOpen {
+		return fmt.Errorf("Can't pin %d databases with at most %d open", len(config.PinnedDBs), config.MaxOpen)
+	}
+	for _, dbname := range config.PinnedDBs {
+		if err := validateDBName(dbname); err != nil {
+			return fmt.Errorf("Can't pin database: %s", err.Error())
+		}
+	}
+	if _, ok := logLevels[config.LogLevel]; !ok && config.LogLevel != "" {
+		return fmt.Errorf("Unknown log level '%s', must be trace, debug, info, warn or error", config.LogLevel)
+	}
+	return nil
+}
+
+// Server serves the databases in a directory. Servers don't share any state,
+// so there can be several in a process as long as they use different
+// directories.
+type Server struct {
+	config  Config
+	dbpath  string // absolute path of config.DBPath
+	codec   codec  // codec of new values
+	auth    *authConfig
+	log     *lumber.ConsoleLogger
+	router  *gin.Engine
+	started time.Time
+
+	dbs      dbCache
+	watchers struct {
+		sync.RWMutex
+		data map[*watcher]bool
+	}
+	migrations struct {
+		sync.Mutex
+		data map[string]bool // databases being migrated
+	}
+	idempotentResponses struct {
+		sync.Mutex
+		data  map[string]*idempotentResponse
+		order *list.List // of *idempotentResponse, oldest first
+		bytes int64      // size of the responses that are done
+	}
+
+	// requests are being handled, which Shutdown waits for
+	requests struct {
+		sync.Mutex
+		sync.WaitGroup
+		closing bool
+	}
+
+	done       chan struct{}  // closed to stop the background work
+	background sync.WaitGroup // background work that Close waits for
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// New returns a server for the databases in config.DBPath, which keeps
+// closing unused databases and sweeping expired keys in the background
+// until it is closed
+func New(config Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = defaultSweepInterval
+	}
+	if config.OpenTimeout == 0 {
+		config.OpenTimeout = defaultOpenTimeout
+	}
+	if config.IdempotencyTTL == 0 {
+		config.IdempotencyTTL = defaultIdempotencyTTL
+	}
+	if config.IdempotencyMaxBytes == 0 {
+		config.IdempotencyMaxBytes = defaultIdempotencyMaxBytes
+	}
+	if err := os.MkdirAll(config.DBPath, 0755); err != nil {
+		return nil, err
+	}
+	dbpath, err := filepath.Abs(config.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:  config,
+		dbpath:  dbpath,
+		codec:   config.valueCodec(),
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	if config.AuthFile != "" {
+		s.auth, err = loadAuthConfig(config.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	level, ok := logLevels[config.LogLevel]
+	if !ok {
+		level = lumber.WARN
+	}
+	if config.Debug {
+		level = lumber.TRACE
+	}
+	s.log = lumber.NewConsoleLogger(level)
+	s.dbs.handles = make(map[string]*dbHandle)
+	s.dbs.lru = list.New()
+	s.dbs.pinned = make(map[string]bool)
+	s.dbs.opening = make(map[string]bool)
+	s.dbs.closing = make(map[string]bool)
+	s.dbs.released = sync.NewCond(&s.dbs.Mutex)
+	for _, dbname := range config.PinnedDBs {
+		s.dbs.pinned[dbname] = true
+	}
+	s.watchers.data = make(map[*watcher]bool)
+	s.migrations.data = make(map[string]bool)
+	s.idempotentResponses.data = make(map[string]*idempotentResponse)
+	s.idempotentResponses.order = list.New()
+	s.router = s.routes()
+
+	s.background.Add(2)
+	go func() {
+		defer s.background.Done()
+		s.closeDBs()
+	}()
+	go func() {
+		defer s.background.Done()
+		s.sweepDBs()
+	}()
+	return s, nil
+}
+
+// ServeHTTP serves the API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Close stops the background work of the server, ends its watch streams and
+// closes the databases that are not being used. Databases that requests are
+// still using are closed once the requests release them, so use Shutdown to
+// wait for the requests. It returns an error listing the databases that
+// could not be closed.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.removeAllWatchers()
+		s.background.Wait()
+		s.closeErr = s.closeAllDBs()
+	})
+	return s.closeErr
+}
+
+// Shutdown closes the server gracefully. New requests fail with 503 and watch
+// streams end, then once the requests being handled have finished, or ctx is
+// done, the server is closed. It returns ctx.Err() if requests didn't finish
+// in time, or else the error of Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.requests.Lock()
+	s.requests.closing = true
+	s.requests.Unlock()
+	s.removeAllWatchers()
+
+	finished := make(chan struct{})
+	go func() {
+		s.requests.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.log.Warn("Closing with requests still being handled: %s", err.Error())
+	}
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closed returns whether the server is shutting down or closed
+func (s *Server) closed() bool {
+	s.requests.Lock()
+	defer s.requests.Unlock()
+	if s.requests.closing {
+		return true
+	}
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackRequests counts the requests being handled for Shutdown, and refuses
+// new ones once it has started
+func (s *Server) trackRequests(c *gin.Context) {
+	s.requests.Lock()
+	if s.requests.closing {
+		s.requests.Unlock()
+		c.Header("Connection", "close")
+		respondError(c, errShuttingDown)
+		return
+	}
+	s.requests.Add(1)
+	s.requests.Unlock()
+	defer s.requests.Done()
+	c.Next()
+}
+
+// routes returns the router of the API
+func (s *Server) routes() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	// Nested bucket paths are escaped like users%2F2024%2Factive, so that
+	// they match a single parameter
+	r.UseRawPath = true
+	if s.config.LogRequests {
+		r.Use(gin.Logger())
+	}
+	r.Use(gin.Recovery(), s.trackRequests, s.logErrors, s.limitBody, s.checkNames)
+	r.NoRoute(func(c *gin.Context) {
+		respondError(c, &apiError{Status: http.StatusNotFound, Code: codeNotFound, Message: "No route for " + c.Request.Method + " " + c.Request.URL.Path})
+	})
+	r.GET("/v1/api", func(c *gin.Context) {
+		c.String(200, `
+
+			// Get map of buckets and the number of keys in each
+			GET /v1/db/<db>/stats
+
+			// Get list of all buckets
+			GET /v1/db/<db>/buckets
+
+			// Get the buckets nested in a bucket
+			GET /v1/db/<db>/bucket/<bucket>/buckets
+
+			// Get the tree of every bucket, or of the buckets nested in a
+			// bucket, with the number of keys in each
+			GET /v1/db/<db>/tree
+			GET /v1/db/<db>/bucket/<bucket>/tree
+
+			// Get all keys and values from a bucket
+			GET /v1/db/<db>/bucket/<bucket>/numkeys
+
+			// Get all keys and values from a bucket, streamed as NDJSON
+			// with Accept: application/x-ndjson
+			GET /v1/db/<db>/bucket/<bucket>/all
+
+			// Get all keys and values specified by ?keys=key1,key2 or by JSON,
+			// where a single key has an ETag of its version and honors
+			// If-Match and If-None-Match
+			GET /v1/db/<db>/bucket/<bucket>/some
+
+			// Get the versions of all keys, or of keys specified by
+			// ?keys=key1,key2 or by JSON
+			GET /v1/db/<db>/bucket/<bucket>/versions
+
+			// Delete and return first n keys, or with ?lease=30s hold them
+			// under a lease until they are acknowledged, and return them
+			// to the bucket if they are not acknowledged in time
+			GET /v1/db/<db>/bucket/<bucket>/pop?n=X
+
+			// Get all keys in a bucket, streamed as NDJSON with
+			// Accept: application/x-ndjson
+			GET /v1/db/<db>/bucket/<bucket>/keys", s.handleGetKeys)
+
+			// Get keys and values in order, optionally filtered by
+			// ?prefix=X&start=X&end=X, paged by ?limit=N&token=X and
+			// reversed with ?reverse=true, or streamed as NDJSON with
+			// Accept: application/x-ndjson
+			GET /v1/db/<db>/bucket/<bucket>/range
+
+			// Get the bytes of a value, with the content type it was
+			// written with, or application/octet-stream, and an ETag
+			// of its version that honors If-Match and If-None-Match
+			GET /v1/db/<db>/bucket/<bucket>/key/<key>
+
+			// Return boolean of whether it has key
+			GET /v1/db/<db>/bucket/<bucket>/haskey/<key>
+
+			// Return boolean of whether any buckets contain any keys specified by JSON
+			GET /v1/db/<db>/haskeys
+
+			// Stream put, delete, move, pop and delete_bucket events as
+			// server-sent events, optionally only for ?bucket=X&prefix=X
+			GET /v1/db/<db>/watch
+
+			// Get the number of open databases and the hits, misses,
+			// evictions and idle closes of the database handle cache
+			GET /v1/cache
+
+			// Download a consistent snapshot of the database file
+			GET /v1/db/<db>/backup
+
+			// Replace the database file with the snapshot in the body, once
+			// the requests using the database have finished
+			PUT /v1/db/<db>/restore
+
+			// Re-encode every value with the codec specified by JSON
+			// {"codec":"zstd","batch_size":1000}, or the codec of the
+			// server, resuming a migration that was interrupted
+			POST /v1/db/<db>/migrate
+
+			// Get the progress of the last migration
+			GET /v1/db/<db>/migrate
+
+			// Delete database file
+			DELETE /v1/db/<db>
+
+			// Delete bucket
+			DELETE /v1/db/<db>/bucket/<bucket>
+
+			// Delete a key
+			DELETE /v1/db/<db>/bucket/<bucket>/key/<key>
+
+			// Delete keys, where keys are specified by JSON []string
+			DELETE /v1/db/<db>/bucket/<bucket>/keys
+
+			// Updates a database with keystore specified by JSON, where keys
+			// can expire after ?ttl=X or by JSON
+			// {"keystore":{...},"ttl":"1h","ttls":{"key":"30s"}}
+			// and can be written only if they hold the conditions
+			// {"if_absent":true} or {"if_values":{...}} or {"if_versions":{...}},
+			// otherwise it returns 409 with the current value. A single key
+			// can also be written with If-Match or If-None-Match: *.
+			// Returns the new version of each key.
+			POST /v1/db/<db>/bucket/<bucket>/update
+
+			// Write the body as the value of a key, with the content type
+			// of the request, optionally expiring after ?ttl=X and only
+			// if it holds If-Match or If-None-Match: *. Keys can contain
+			// slashes. Returns the new version of the key.
+			PUT /v1/db/<db>/bucket/<bucket>/key/<key>
+
+			// Move keys, with buckets and keys specified by JSON
+			POST /v1/db/<db>/move
+
+			// Create buckets specified by JSON
+			POST /v1/db/<db>/create
+
+			// Atomically apply put, delete, move, create_bucket and
+			// delete_bucket ops specified by JSON, if the preconditions hold
+			POST /v1/db/<db>/tx
+
+			// Acknowledge keys popped with a lease, so they are not returned,
+			// with lease and keys (or all keys if none) specified by JSON
+			POST /v1/db/<db>/bucket/<bucket>/ack
+
+			// Return keys popped with a lease to the bucket now, with lease
+			// and keys (or all keys if none) specified by JSON
+			POST /v1/db/<db>/bucket/<bucket>/nack
+
+`)
+	})
+	r.GET("/v1/uptime", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"uptime": time.Since(s.started).String(),
+		})
+	})
+	r.GET("/v1/cache", s.authorize(adminAccess), s.handleCacheStats)
+	r.GET("/v1/db/:dbname/stats", s.authorize(readAccess), s.handleGetDBStats)                       // Get map of buckets and the number of keys in each
+	r.GET("/v1/db/:dbname/buckets", s.authorize(readAccess), s.handleGetBuckets)                     // Get list of all buckets
+	r.GET("/v1/db/:dbname/tree", s.authorize(readAccess), s.handleGetTree)                           // Get the tree of every bucket
+	r.GET("/v1/db/:dbname/bucket/:bucket/buckets", s.authorize(readAccess), s.handleGetChildBuckets) // Get the buckets nested in a bucket
+	r.GET("/v1/db/:dbname/bucket/:bucket/tree", s.authorize(readAccess), s.handleGetTree)            // Get the tree of the buckets nested in a bucket
+	r.GET("/v1/db/:dbname/bucket/:bucket/numkeys", s.authorize(readAccess), s.handleGetNumKeys)      // Get all keys and values from a bucket (no parameters)
+	r.GET("/v1/db/:dbname/bucket/:bucket/all", s.authorize(readAccess), s.handleGet)                 // Get all keys and values from a bucket (no parameters)
+	r.GET("/v1/db/:dbname/bucket/:bucket/some", s.authorize(readAccess), s.handleGet)                // Get all keys and values specified by ?keys=key1,key2 or by JSON
+	r.GET("/v1/db/:dbname/bucket/:bucket/pop", s.authorize(writeAccess), s.idempotent, s.handlePop)  // Delete and return first n keys + values, where n specified by ?n=100
+	r.GET("/v1/db/:dbname/bucket/:bucket/keys", s.authorize(readAccess), s.handleGetKeys)            // Get all keys in a bucket (no parameters)
+	r.GET("/v1/db/:dbname/bucket/:bucket/range", s.authorize(readAccess), s.handleRange)             // Get keys and values in order, specified by ?prefix=X&start=X&end=X&limit=N&reverse=true&token=X
+	r.GET("/v1/db/:dbname/bucket/:bucket/versions", s.authorize(readAccess), s.handleGetVersions)    // Get versions of all keys, or of keys specified by ?keys=key1,key2 or by JSON
+	r.GET("/v1/db/:dbname/bucket/:bucket/key/*key", s.authorize(readAccess), s.handleGetRaw)         // Get the bytes of a value, with its content type
+	r.GET("/v1/db/:dbname/bucket/:bucket/haskey/:key", s.authorize(readAccess), s.handleHasKey)      // Return boolean of whether it has key
+	r.GET("/v1/db/:dbname/haskeys", s.authorize(readAccess), s.handleHasKeys)                        // Return boolean of whether any of the buckets contain the keys
+	r.GET("/v1/db/:dbname/watch", s.authorize(readAccess), s.handleWatch)                            // Stream changes as server-sent events, optionally only those specified by ?bucket=X&prefix=X
+	r.GET("/v1/db/:dbname/backup", s.authorize(adminAccess), s.handleBackup)                         // Stream a consistent snapshot of the database file
+	r.GET("/v1/db/:dbname/migrate", s.authorize(adminAccess), s.handleMigration)                     // Get the progress of the last migration
+	// TODO: r.GET("/v1/db/:dbname/bucket/:bucket/data", getDataArchive)   // Creates archive with keys as filenames and values as contents, returns archive
+
+	r.DELETE("/v1/db/:dbname", s.authorize(adminAccess), s.idempotent, s.handleDeleteDatabase)                    // Delete database file (no parameters)
+	r.DELETE("/v1/db/:dbname/bucket/:bucket", s.authorize(adminAccess), s.idempotent, s.handleDeleteBucket)       // Delete bucket (no parameters)
+	r.DELETE("/v1/db/:dbname/bucket/:bucket/key/*key", s.authorize(writeAccess), s.idempotent, s.handleDeleteRaw) // Delete a key
+	r.DELETE("/v1/db/:dbname/bucket/:bucket/keys", s.authorize(writeAccess), s.idempotent, s.handleDeleteKeys)    // Delete keys, where keys are specified by JSON []string
+	//
+	r.POST("/v1/db/:dbname/bucket/:bucket/update", s.authorize(writeAccess), s.idempotent, s.handleUpdate)  // Updates a database with keystore specified by JSON
+	r.POST("/v1/db/:dbname/move", s.authorize(writeAccess), s.idempotent, s.handleMove)                     // Move keys, with buckets and keys specified by JSON
+	r.POST("/v1/db/:dbname/create", s.authorize(writeAccess), s.idempotent, s.handleCreateDB)               // Move keys, with buckets and keys specified by JSON
+	r.PUT("/v1/db/:dbname/bucket/:bucket/key/*key", s.authorize(writeAccess), s.idempotent, s.handlePutRaw) // Write the body as the value of a key, with its content type
+	r.PUT("/v1/db/:dbname/restore", s.authorize(adminAccess), s.handleRestore)                              // Replace the database file with the snapshot in the body
+	r.POST("/v1/db/:dbname/migrate", s.authorize(adminAccess), s.handleMigrate)                             // Re-encode every value with the codec specified by JSON
+	r.POST("/v1/db/:dbname/tx", s.authorize(writeAccess), s.idempotent, s.handleTransaction)                // Atomically apply ops, with ops and preconditions specified by JSON
+	r.POST("/v1/db/:dbname/bucket/:bucket/ack", s.authorize(writeAccess), s.idempotent, s.handleAck)        // Acknowledge keys popped with a lease, with lease and keys specified by JSON
+	r.POST("/v1/db/:dbname/bucket/:bucket/nack", s.authorize(writeAccess), s.idempotent, s.handleNack)      // Return keys popped with a lease to the bucket, with lease and keys specified by JSON
+
+	return r
+}
+
+// limitBody rejects request bodies larger than the configured limit, except
+// for restores, whose snapshots can be as large as the database
+func (s *Server) limitBody(c *gin.Context) {
+	if s.config.MaxBodySize <= 0 || c.Request.Body == nil || strings.HasSuffix(c.Request.URL.Path, "/restore") {
+		return
+	}
+	if c.Request.ContentLength > s.config.MaxBodySize {
+		respondError(c, requestTooLarge(s.config.MaxBodySize))
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.config.MaxBodySize)
+}
@@ -0,0 +1,967 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func newTestServer(t *testing.T, config Config) *Server {
+	dir, err := ioutil.TempDir("", "boltdb-server-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DBPath = dir
+	s, err := New(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+	return s
+}
+
+func request(s *Server, method string, target string, body string) (int, string) {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func TestMultipleServers(t *testing.T) {
+	s1 := newTestServer(t, Config{})
+	s2 := newTestServer(t, Config{Compress: true})
+
+	if code, body := request(s1, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"apple":"red"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	if code, body := request(s2, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"apple":"green"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+
+	if _, body := request(s1, "GET", "/v1/db/test/bucket/food/all", ""); body != `{"apple":"red"}` {
+		t.Errorf("First server should keep its own value: %s", body)
+	}
+	if _, body := request(s2, "GET", "/v1/db/test/bucket/food/all", ""); body != `{"apple":"green"}` {
+		t.Errorf("Second server should keep its own value: %s", body)
+	}
+	if _, err := os.Stat(s1.dbpath + "/test.db"); err != nil {
+		t.Errorf("Database should be in the directory of the first server: %v", err)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltdb-server-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authFile := dir + "/auth.json"
+	err = ioutil.WriteFile(authFile, []byte(`{"users":[{"name":"zack","api_keys":["k3y"],"grants":[{"db":"*","access":"admin"}]}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the server with auth requires credentials
+	withAuth := newTestServer(t, Config{AuthFile: authFile})
+	withoutAuth := newTestServer(t, Config{})
+	if err = withoutAuth.createDatabase("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := request(withAuth, "GET", "/v1/db/test/buckets", ""); code != http.StatusUnauthorized {
+		t.Errorf("Server with auth should require credentials, got %d", code)
+	}
+	if code, _ := request(withoutAuth, "GET", "/v1/db/test/buckets", ""); code != http.StatusOK {
+		t.Errorf("Server without auth should not require credentials, got %d", code)
+	}
+
+	if _, err = New(Config{DBPath: dir, AuthFile: dir + "/missing.json"}); err == nil {
+		t.Errorf("New should fail with a missing auth file")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if code, body := request(s, "POST", "/v1/db/test/create", `["food"]`); code != http.StatusOK {
+		t.Fatalf("Problem creating bucket: %d %s", code, body)
+	}
+	if len(s.dbs.handles) != 1 {
+		t.Errorf("Database should be open")
+	}
+	s.Close()
+	s.Close()
+	if len(s.dbs.handles) != 0 {
+		t.Errorf("Close should close the databases")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s := newTestServer(t, Config{MaxBodySize: 100, MaxPop: 2, MaxRangeLimit: 1})
+	if code, body := request(s, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"a":"1","b":"2","c":"3"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	if code, body := request(s, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"d":"`+strings.Repeat("x", 100)+`"}}`); code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "request_too_large") {
+		t.Errorf("Large body should be rejected: %d %s", code, body)
+	}
+	// Bodies without a length are rejected once they are read for an
+	// Idempotency-Key
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/db/test/bucket/food/update", strings.NewReader(`{"keystore":{"d":"`+strings.Repeat("x", 100)+`"}}`))
+	r.ContentLength = -1
+	r.Header.Set("Idempotency-Key", "k1")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "request_too_large") {
+		t.Errorf("Large body with Idempotency-Key should be rejected: %d %s", w.Code, w.Body.String())
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/food/range?limit=10", ""); !strings.Contains(body, `"next"`) || strings.Count(body, `"key"`) != 1 {
+		t.Errorf("Range should return at most 1 key: %s", body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/food/pop?n=10", ""); strings.Count(body, ":") != 2 {
+		t.Errorf("Pop should return at most 2 keys: %s", body)
+	}
+
+	for _, config := range []Config{
+		{},
+		{DBPath: "dbs", MaxPop: -1},
+		{DBPath: "dbs", LogLevel: "loud"},
+		{DBPath: "dbs", Codec: "lz4"},
+		{DBPath: "dbs", MaxOpen: 1, PinnedDBs: []string{"a", "b"}},
+		{DBPath: "dbs", PinnedDBs: []string{"../a"}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Config should not be valid: %+v", config)
+		}
+	}
+}
+
+func TestRangeTokens(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if code, body := request(s, "POST", "/v1/db/test/bucket/q/update", `{"keystore":{"a":"1","b":"2","c":"3","d":"4","e":"5"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	for query, want := range map[string]string{
+		// Tokens outside the range resume at its edge
+		"reverse=true&end=d&token=" + encodeRangeToken([]byte("e")): "c,b,a",
+		"reverse=true&end=d&token=" + encodeRangeToken([]byte("d")): "c,b,a",
+		"reverse=true&end=d&token=" + encodeRangeToken([]byte("b")): "b,a",
+		"start=c&token=" + encodeRangeToken([]byte("a")):            "c,d,e",
+		"start=c&token=" + encodeRangeToken([]byte("d")):            "d,e",
+	} {
+		code, body := request(s, "GET", "/v1/db/test/bucket/q/range?"+query, "")
+		var page struct {
+			Entries []keyValue `json:"entries"`
+		}
+		json.Unmarshal([]byte(body), &page)
+		var keys []string
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if code != http.StatusOK || strings.Join(keys, ",") != want {
+			t.Errorf("Range with %s should return %s: %d %s", query, want, code, body)
+		}
+	}
+}
+
+func TestReadMissingDatabase(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, target := range []string{
+		"/v1/db/nosuch/buckets",
+		"/v1/db/nosuch/stats",
+		"/v1/db/nosuch/bucket/food/all",
+		"/v1/db/nosuch/bucket/food/keys",
+		"/v1/db/nosuch/bucket/food/range",
+		"/v1/db/nosuch/bucket/food/key/apple",
+	} {
+		if code, body := request(s, "GET", target, ""); code != http.StatusNotFound || !strings.Contains(body, "db_not_found") {
+			t.Errorf("%s should not find the database: %d %s", target, code, body)
+		}
+	}
+	if s.databaseExists("nosuch") {
+		t.Errorf("Reads should not create the database")
+	}
+
+	// Writes create it
+	if code, body := request(s, "POST", "/v1/db/nosuch/bucket/food/update", `{"keystore":{"apple":"red"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	if code, body := request(s, "GET", "/v1/db/nosuch/buckets", ""); code != http.StatusOK || body != `["food"]` {
+		t.Errorf("Problem getting buckets of created database: %d %s", code, body)
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := newTestServer(t, Config{MaxOpen: 2, PinnedDBs: []string{"hot"}})
+	for _, dbname := range []string{"hot", "a", "b", "c", "hot"} {
+		if code, body := request(s, "POST", "/v1/db/"+dbname+"/create", `["food"]`); code != http.StatusOK {
+			t.Fatalf("Problem creating bucket in %s: %d %s", dbname, code, body)
+		}
+	}
+	stats := s.CacheStats()
+	if stats.Open != 2 || stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 2 {
+		t.Errorf("Least recently used databases should be evicted: %+v", stats)
+	}
+	if _, ok := s.dbs.handles["hot"]; !ok {
+		t.Errorf("Pinned database should not be evicted")
+	}
+	if _, ok := s.dbs.handles["c"]; !ok {
+		t.Errorf("Most recently used database should stay open")
+	}
+
+	// Databases being used are not evicted, even over the limit
+	db, release, err := s.getDB("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, releaseB, err := s.getDB("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats = s.CacheStats(); stats.Open != 3 || stats.InUse != 2 {
+		t.Errorf("Databases being used should stay open over the limit: %+v", stats)
+	}
+	if err = db.View(func(*bolt.Tx) error { return nil }); err != nil {
+		t.Errorf("Database being used should stay open: %v", err)
+	}
+	release()
+	release()
+	if stats = s.CacheStats(); stats.Open != 2 || stats.InUse != 1 {
+		t.Errorf("Released database should be evicted once: %+v", stats)
+	}
+	if _, ok := s.dbs.handles["a"]; ok {
+		t.Errorf("Released database should be evicted")
+	}
+	releaseB()
+
+	if code, body := request(s, "GET", "/v1/cache", ""); code != http.StatusOK || !strings.Contains(body, `"evictions":`) {
+		t.Errorf("Problem getting cache stats: %d %s", code, body)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	s := newTestServer(t, Config{OpenTimeout: 500 * time.Millisecond})
+	if code, body := request(s, "POST", "/v1/db/test/create", `["food"]`); code != http.StatusOK {
+		t.Fatalf("Problem creating bucket: %d %s", code, body)
+	}
+	// Lock the file of another database, like another process would
+	filename, _ := s.dbFilename("locked")
+	db, err := bolt.Open(filename, 0755, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	locked := make(chan int)
+	go func() {
+		code, _ := request(s, "GET", "/v1/db/locked/buckets", "")
+		locked <- code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if code, body := request(s, "GET", "/v1/db/test/buckets", ""); code != http.StatusOK {
+		t.Errorf("Problem getting buckets: %d %s", code, body)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Other databases should not wait for a locked file: %s", elapsed)
+	}
+	if code := <-locked; code != http.StatusInternalServerError {
+		t.Errorf("Locked database should fail to open: %d", code)
+	}
+	if _, ok := s.dbs.handles["locked"]; ok || len(s.dbs.opening) != 0 {
+		t.Errorf("Locked database should not be cached")
+	}
+}
+
+func TestIdleClose(t *testing.T) {
+	s := newTestServer(t, Config{IdleTimeout: 50 * time.Millisecond, PinnedDBs: []string{"hot"}})
+	for _, dbname := range []string{"hot", "cold"} {
+		if code, body := request(s, "POST", "/v1/db/"+dbname+"/create", `["food"]`); code != http.StatusOK {
+			t.Fatalf("Problem creating bucket in %s: %d %s", dbname, code, body)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	stats := s.CacheStats()
+	if stats.Open != 1 || stats.IdleCloses != 1 {
+		t.Errorf("Idle database should be closed: %+v", stats)
+	}
+	if _, ok := s.dbs.handles["hot"]; !ok {
+		t.Errorf("Pinned database should not be closed")
+	}
+}
+
+func TestDeleteInUse(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, dbname := range []string{"one", "two"} {
+		if code, body := request(s, "POST", "/v1/db/"+dbname+"/bucket/food/update", `{"keystore":{"apple":"red","banana":"yellow"}}`); code != http.StatusOK {
+			t.Fatalf("Problem updating %s: %d %s", dbname, code, body)
+		}
+	}
+
+	// Hold a read transaction on one while it is deleted
+	db, release, err := s.getDB("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := make(chan int)
+	go func() {
+		code, _ := request(s, "DELETE", "/v1/db/one", "")
+		deleted <- code
+	}()
+	select {
+	case code := <-deleted:
+		t.Fatalf("Database should not be deleted while it is used: %d", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, body := request(s, "GET", "/v1/db/two/bucket/food/all", ""); body != `{"apple":"red","banana":"yellow"}` {
+		t.Errorf("Other databases should be available while waiting: %s", body)
+	}
+	// The memory of the transaction is still mapped
+	n := 0
+	tx.Bucket([]byte("food")).ForEach(func(k, v []byte) error {
+		n++
+		return nil
+	})
+	if n != 2 {
+		t.Errorf("Transaction should still read the database: %d keys", n)
+	}
+	tx.Rollback()
+	release()
+
+	if code := <-deleted; code != http.StatusOK {
+		t.Errorf("Problem deleting database once released: %d", code)
+	}
+	if s.databaseExists("one") {
+		t.Errorf("Database should be deleted")
+	}
+}
+
+func TestRestoreInUse(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if code, body := request(s, "POST", "/v1/db/snapshot/bucket/food/update", `{"keystore":{"apple":"green"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	snapshot := httptest.NewRecorder()
+	s.ServeHTTP(snapshot, httptest.NewRequest("GET", "/v1/db/snapshot/backup", nil))
+	if code, body := request(s, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"apple":"red"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+
+	// Start a backup of the database that blocks while writing it
+	w := newBlockingWriter()
+	backedUp := make(chan struct{})
+	go func() {
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/v1/db/test/backup", nil))
+		close(backedUp)
+	}()
+	<-w.writing
+
+	restored := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/db/test/restore", bytes.NewReader(snapshot.Body.Bytes())))
+		restored <- w.Code
+	}()
+	select {
+	case code := <-restored:
+		t.Fatalf("Database should not be replaced while it is backed up: %d", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(w.unblock)
+	<-backedUp
+	if code := <-restored; code != http.StatusOK {
+		t.Fatalf("Problem restoring once the backup finished: %d", code)
+	}
+	if err := checkSnapshot(w.Body.Bytes()); err != nil {
+		t.Errorf("Backup taken during restore should be consistent: %s", err)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/food/all", ""); body != `{"apple":"green"}` {
+		t.Errorf("Problem reading restored database: %s", body)
+	}
+}
+
+// blockingWriter is a response that blocks its first write until unblock is
+// closed
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), unblock: make(chan struct{})}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.unblock
+	})
+	return w.ResponseRecorder.Write(p)
+}
+
+// checkSnapshot returns an error if a backup is not a consistent database
+func checkSnapshot(b []byte) error {
+	f, err := ioutil.TempFile("", "boltdb-server-snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return checkDatabaseFile(f.Name())
+}
+
+func TestLeaseIDs(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, dbname := range []string{"one", "two"} {
+		if code, body := request(s, "POST", "/v1/db/"+dbname+"/bucket/jobs/update", `{"keystore":{"a":"1","b":"2","c":"3","d":"4"}}`); code != http.StatusOK {
+			t.Fatalf("Problem updating %s: %d %s", dbname, code, body)
+		}
+	}
+
+	// Leased pops on different databases run at once
+	var wg sync.WaitGroup
+	leases := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(dbname string) {
+			defer wg.Done()
+			_, body := request(s, "GET", "/v1/db/"+dbname+"/bucket/jobs/pop?n=1&lease=30s", "")
+			var lease leaseJSON
+			json.Unmarshal([]byte(body), &lease)
+			leases <- lease.Lease
+		}([]string{"one", "two"}[i%2])
+	}
+	wg.Wait()
+	close(leases)
+	seen := make(map[string]bool)
+	for lease := range leases {
+		if len(lease) != 32 || seen[lease] {
+			t.Errorf("Lease IDs should be 16 random bytes in hex: %q", lease)
+		}
+		seen[lease] = true
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	value := strings.Repeat("compressible ", 20)
+	for name, c := range codecs {
+		s := newTestServer(t, Config{Codec: name, CompressMinSize: 10})
+		for _, v := range []string{"", "small", value} {
+			b := s.encodeValue(v)
+			if codec(b[0]) != c && len(v) >= 10 {
+				t.Errorf("%s: value should be written with its codec: %#x", name, b[0])
+			}
+			if len(v) < 10 && codec(b[0]) != codecNone {
+				t.Errorf("%s: small value should not be compressed: %#x", name, b[0])
+			}
+			// Values are read whatever the codec of the server
+			decoded, err := (&Server{codec: codecNone}).decodeValue(b)
+			if err != nil || decoded != v {
+				t.Errorf("%s: problem decoding %q: %q %v", name, v, decoded, err)
+			}
+		}
+	}
+
+	// Values written before there were markers
+	var legacy bytes.Buffer
+	w, _ := flate.NewWriter(&legacy, 9)
+	w.Write([]byte(value))
+	w.Close()
+	s := newTestServer(t, Config{})
+	for _, b := range [][]byte{[]byte(value), legacy.Bytes()} {
+		if decoded, err := s.decodeValue(b); err != nil || decoded != value {
+			t.Errorf("Problem decoding legacy value %q: %q %v", b, decoded, err)
+		}
+	}
+
+	if code, body := request(s, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"apple":"red"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	db, release, err := s.getDB("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("food")).Put([]byte("apple"), append([]byte{byte(codecGzip)}, "not gzip"...))
+	})
+	release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := request(s, "GET", "/v1/db/test/bucket/food/all", ""); code != http.StatusInternalServerError || !strings.Contains(body, "corrupt_value") {
+		t.Errorf("Corrupt value should be an error: %d %s", code, body)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	s := newTestServer(t, Config{})
+	value := strings.Repeat("compressible ", 20)
+	for _, bucket := range []string{"food", "drinks"} {
+		body := `{"keystore":{"a":"` + value + `","b":"` + value + `","c":"` + value + `"}}`
+		if code, body := request(s, "POST", "/v1/db/test/bucket/"+bucket+"/update", body); code != http.StatusOK {
+			t.Fatalf("Problem updating: %d %s", code, body)
+		}
+	}
+
+	// Stop after the first batch, then resume
+	ctx, cancel := context.WithCancel(context.Background())
+	status, err := s.Migrate(ctx, "test", MigrateOptions{Codec: "zstd", BatchSize: 2, Progress: func(MigrationStatus) { cancel() }})
+	if err != context.Canceled || status.Scanned != 2 || status.Done {
+		t.Fatalf("Migration should stop when canceled: %+v %v", status, err)
+	}
+	if status, _ = s.Migration("test"); status.Bucket != "drinks" || status.Key != "b" {
+		t.Errorf("Progress should be saved: %+v", status)
+	}
+	batches := 0
+	status, err = s.Migrate(context.Background(), "test", MigrateOptions{Codec: "zstd", BatchSize: 2, Progress: func(MigrationStatus) { batches++ }})
+	if err != nil || !status.Done || status.Scanned != 6 || status.Rewritten != 6 || batches != 3 {
+		t.Errorf("Migration should resume: %+v %v after %d batches", status, err, batches)
+	}
+
+	db, release, err := s.getDB("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("food")).Get([]byte("a")); codec(v[0]) != codecZstd {
+			t.Errorf("Value should be written with zstd: %#x", v[0])
+		}
+		return nil
+	})
+	release()
+	if _, body := request(s, "GET", "/v1/db/test/bucket/food/all", ""); strings.Count(body, value) != 3 {
+		t.Errorf("Migrated values should be read: %s", body)
+	}
+
+	if code, body := request(s, "POST", "/v1/db/test/migrate", `{"codec":"snappy"}`); code != http.StatusOK || !strings.Contains(body, `"rewritten":6`) {
+		t.Errorf("Problem migrating: %d %s", code, body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/migrate", ""); !strings.Contains(body, `"codec":"snappy"`) || !strings.Contains(body, `"done":true`) {
+		t.Errorf("Problem getting migration: %s", body)
+	}
+	if code, body := request(s, "POST", "/v1/db/test/migrate", `{"codec":"lz4"}`); code != http.StatusBadRequest {
+		t.Errorf("Unknown codec should be rejected: %d %s", code, body)
+	}
+}
+
+func TestRawKeys(t *testing.T) {
+	s := newTestServer(t, Config{Compress: true})
+	put := func(value []byte, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/v1/db/test/bucket/files/key/a/b.bin", bytes.NewReader(value))
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		s.ServeHTTP(w, r)
+		return w
+	}
+	get := func(header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/db/test/bucket/files/key/a/b.bin", nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	value := append([]byte{0x00, 0xff, 0xf6}, bytes.Repeat([]byte{0x80}, 100)...)
+	w := put(value, "Content-Type", "application/x-protobuf", "If-None-Match", "*")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+		t.Fatalf("Problem putting raw key: %d %s", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if w = put(value, "If-None-Match", "*"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Existing key should fail If-None-Match: %d %s", w.Code, w.Body.String())
+	}
+
+	w = get()
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) || w.Header().Get("Content-Type") != "application/x-protobuf" || w.Header().Get("ETag") != etag {
+		t.Errorf("Problem getting raw key: %d %v %v", w.Code, w.Body.Bytes(), w.Header())
+	}
+	if w = get("If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Matching If-None-Match should not be modified: %d", w.Code)
+	}
+	if w = get("If-Match", `"1000"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Different If-Match should fail: %d", w.Code)
+	}
+
+	// Writing the key as JSON forgets its content type
+	if code, body := request(s, "POST", "/v1/db/test/bucket/files/update", `{"a/b.bin":"text"}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	if w = get(); w.Body.String() != "text" || w.Header().Get("Content-Type") != defaultContentType {
+		t.Errorf("JSON value should be returned as stored: %s %v", w.Body.String(), w.Header())
+	}
+
+	if code, body := request(s, "DELETE", "/v1/db/test/bucket/files/key/a/b.bin", ""); code != http.StatusOK {
+		t.Errorf("Problem deleting raw key: %d %s", code, body)
+	}
+	if code, body := request(s, "DELETE", "/v1/db/test/bucket/files/key/a/b.bin", ""); code != http.StatusNotFound || !strings.Contains(body, "key_not_found") {
+		t.Errorf("Deleted key should not be found: %d %s", code, body)
+	}
+	if w = get(); w.Code != http.StatusNotFound {
+		t.Errorf("Deleted key should not be found: %d", w.Code)
+	}
+}
+
+func TestNestedBuckets(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if code, body := request(s, "POST", "/v1/db/test/bucket/users%2F2024%2Factive/update", `{"keystore":{"ann":"1","bob":"2"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating nested bucket: %d %s", code, body)
+	}
+	if code, body := request(s, "POST", "/v1/db/test/bucket/users/update", `{"keystore":{"count":"2"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating parent bucket: %d %s", code, body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/users%2F2024%2Factive/all", ""); body != `{"ann":"1","bob":"2"}` {
+		t.Errorf("Problem getting nested bucket: %s", body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/users/all", ""); body != `{"count":"2"}` {
+		t.Errorf("Nested buckets should not be returned as keys: %s", body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/users/numkeys", ""); body != "1" {
+		t.Errorf("Nested buckets should not be counted as keys: %s", body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/users/buckets", ""); body != `["2024"]` {
+		t.Errorf("Problem getting child buckets: %s", body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/tree", ""); body != `{"name":"","path":"","keys":0,"buckets":[{"name":"users","path":"users","keys":1,"buckets":[{"name":"2024","path":"users/2024","keys":0,"buckets":[{"name":"active","path":"users/2024/active","keys":2,"buckets":[]}]}]}]}` {
+		t.Errorf("Problem getting tree: %s", body)
+	}
+	if code, body := request(s, "GET", "/v1/db/test/bucket/users%2F2025/tree", ""); code != http.StatusNotFound || !strings.Contains(body, "bucket_not_found") {
+		t.Errorf("Missing nested bucket should not be found: %d %s", code, body)
+	}
+
+	// A bucket can't be created where there is a key, and paths can't have
+	// empty names
+	if code, body := request(s, "POST", "/v1/db/test/bucket/users%2Fcount/update", `{"keystore":{"a":"1"}}`); code != http.StatusConflict || !strings.Contains(body, "incompatible_value") {
+		t.Errorf("Bucket over a key should be incompatible: %d %s", code, body)
+	}
+	if code, body := request(s, "POST", "/v1/db/test/bucket/users/update", `{"keystore":{"2024":"1"}}`); code != http.StatusConflict || !strings.Contains(body, "incompatible_value") {
+		t.Errorf("Key over a bucket should be incompatible: %d %s", code, body)
+	}
+	if code, body := request(s, "POST", "/v1/db/test/bucket/users%2F%2Fx/update", `{"keystore":{"a":"1"}}`); code != http.StatusBadRequest || !strings.Contains(body, "invalid_name") {
+		t.Errorf("Empty bucket name should be invalid: %d %s", code, body)
+	}
+
+	if code, body := request(s, "DELETE", "/v1/db/test/bucket/users%2F2024", ""); code != http.StatusOK {
+		t.Fatalf("Problem deleting nested bucket: %d %s", code, body)
+	}
+	if _, body := request(s, "GET", "/v1/db/test/bucket/users/buckets", ""); body != `[]` {
+		t.Errorf("Deleted bucket should not be listed: %s", body)
+	}
+	if code, body := request(s, "GET", "/v1/db/test/bucket/users%2F2024%2Factive/all", ""); code != http.StatusNotFound {
+		t.Errorf("Buckets in deleted bucket should not be found: %d %s", code, body)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	s := newTestServer(t, Config{MaxRangeLimit: 1})
+	stream := func(target string) (int, string, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept", "application/x-ndjson")
+		s.ServeHTTP(w, r)
+		return w.Code, w.Header().Get("Content-Type"), w.Body.String()
+	}
+	if code, body := request(s, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"apple":"red","banana":"yellow","cherry":"red"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+
+	code, contentType, body := stream("/v1/db/test/bucket/food/all")
+	if code != http.StatusOK || contentType != "application/x-ndjson" || body != `{"key":"apple","value":"red"}
+{"key":"banana","value":"yellow"}
+{"key":"cherry","value":"red"}
+` {
+		t.Errorf("Problem streaming all: %d %s %s", code, contentType, body)
+	}
+	if _, _, body = stream("/v1/db/test/bucket/food/keys"); body != `{"key":"apple"}
+{"key":"banana"}
+{"key":"cherry"}
+` {
+		t.Errorf("Problem streaming keys: %s", body)
+	}
+	// Streams are not limited by MaxRangeLimit
+	if _, _, body = stream("/v1/db/test/bucket/food/range?reverse=true&limit=2"); body != `{"key":"cherry","value":"red"}
+{"key":"banana","value":"yellow"}
+{"next":"YXBwbGU"}
+` {
+		t.Errorf("Problem streaming range: %s", body)
+	}
+
+	// Errors before the stream starts are sent as usual, and errors after it
+	// starts end it
+	if code, _, body = stream("/v1/db/test/bucket/drinks/all"); code != http.StatusNotFound || !strings.Contains(body, "bucket_not_found") {
+		t.Errorf("Missing bucket should not be found: %d %s", code, body)
+	}
+	db, release, err := s.getDB("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("food")).Put([]byte("banana"), append([]byte{byte(codecGzip)}, "not gzip"...))
+	})
+	release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, body = stream("/v1/db/test/bucket/food/all"); code != http.StatusOK || !strings.HasPrefix(body, `{"key":"apple","value":"red"}
+{"error":{"status":500,"code":"corrupt_value",`) {
+		t.Errorf("Corrupt value should end the stream: %d %s", code, body)
+	}
+}
+
+func TestIdempotencyLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltdb-server-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authFile := dir + "/auth.json"
+	err = ioutil.WriteFile(authFile, []byte(`{"users":[
+		{"name":"one","cert_subjects":["one"],"grants":[{"db":"*","access":"write"}]},
+		{"name":"two","cert_subjects":["two"],"grants":[{"db":"*","access":"write"}]}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{AuthFile: authFile, IdempotencyMaxBytes: 300})
+	pop := func(user string, key string) *httptest.ResponseRecorder {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: user}}
+		r := httptest.NewRequest("GET", "/v1/db/test/bucket/jobs/pop?n=1", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if err = s.createDatabase("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.updateDatabase("test", "jobs", map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}, nil, writeConditions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users with certificates have their own keys
+	if w := pop("one", "k1"); w.Code != http.StatusOK || w.Body.String() != `{"a":"1"}` {
+		t.Fatalf("Problem popping: %d %s", w.Code, w.Body.String())
+	}
+	if w := pop("two", "k1"); w.Body.String() != `{"b":"2"}` || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Another user should not get the response of the same key: %s", w.Body.String())
+	}
+	if w := pop("one", "k1"); w.Body.String() != `{"a":"1"}` || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Retry should be replayed: %s", w.Body.String())
+	}
+
+	// The oldest responses are dropped to stay under the limit
+	pop("one", "k2")
+	s.idempotentResponses.Lock()
+	n, size := len(s.idempotentResponses.data), s.idempotentResponses.bytes
+	s.idempotentResponses.Unlock()
+	if n != 2 || size > 300 {
+		t.Errorf("Responses should be kept under the limit: %d responses of %d bytes", n, size)
+	}
+	if w := pop("one", "k1"); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Dropped response should not be replayed: %s", w.Body.String())
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltdb-server-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authFile := dir + "/auth.json"
+	err = ioutil.WriteFile(authFile, []byte(`{"users":[
+		{"name":"worker","cert_subjects":["worker"],"grants":[{"db":"jobs","access":"write"}]},
+		{"name":"admin","cert_subjects":["CN=admin,O=Acme"],"grants":[{"db":"*","access":"admin"}]}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{AuthFile: authFile})
+	for _, dbname := range []string{"jobs", "other"} {
+		if err = s.createDatabase(dbname, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requestWithCert := func(target string, subject pkix.Name, verified bool) int {
+		cert := &x509.Certificate{Subject: subject}
+		r := httptest.NewRequest("GET", target, nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	worker := pkix.Name{CommonName: "worker"}
+	admin := pkix.Name{CommonName: "admin", Organization: []string{"Acme"}}
+	if code := requestWithCert("/v1/db/jobs/buckets", worker, true); code != http.StatusOK {
+		t.Errorf("Worker certificate should have access to jobs, got %d", code)
+	}
+	if code := requestWithCert("/v1/db/other/buckets", worker, true); code != http.StatusForbidden {
+		t.Errorf("Worker certificate should not have access to other, got %d", code)
+	}
+	if code := requestWithCert("/v1/db/other/buckets", admin, true); code != http.StatusOK {
+		t.Errorf("Admin certificate should match the whole subject, got %d", code)
+	}
+	if code := requestWithCert("/v1/db/jobs/buckets", worker, false); code != http.StatusUnauthorized {
+		t.Errorf("Unverified certificate should not sign in, got %d", code)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newTestServer(t, Config{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	if code, body := request(s, "POST", "/v1/db/test/create", `["food"]`); code != http.StatusOK {
+		t.Fatalf("Problem creating bucket: %d %s", code, body)
+	}
+
+	// A watch stream ends when the server shuts down
+	resp, err := http.Get(ts.URL + "/v1/db/test/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// A request whose body is still being sent is waited for
+	body := newSlowBody()
+	handled := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/db/test/bucket/food/update", body))
+		handled <- w.Code
+	}()
+	<-body.reading
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if code, body := request(s, "GET", "/v1/db/test/buckets", ""); code != http.StatusServiceUnavailable || !strings.Contains(body, "shutting_down") {
+		t.Errorf("New requests should be refused while shutting down: %d %s", code, body)
+	}
+	stream, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(stream), "event:shutdown") {
+		t.Errorf("Watch stream should end with a shutdown event: %s", stream)
+	}
+
+	body.send(`{"keystore":{"apple":"red"}}`)
+	if code := <-handled; code != http.StatusOK {
+		t.Errorf("Request being handled should finish, got %d", code)
+	}
+	if err = <-shutdown; err != nil {
+		t.Errorf("Shutdown should wait for the request: %v", err)
+	}
+	if len(s.dbs.handles) != 0 {
+		t.Errorf("Shutdown should close the databases")
+	}
+	if code, _ := request(s, "GET", "/v1/db/test/buckets", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("Requests after shutdown should be refused, got %d", code)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := newTestServer(t, Config{})
+	body := newSlowBody()
+	defer body.send("")
+	go s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/db/test/bucket/food/update", body))
+	<-body.reading
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown should give up on requests that don't finish: %v", err)
+	}
+}
+
+// slowBody is a request body that is sent once the handler has started
+// reading it
+func TestCloseInUse(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if code, body := request(s, "POST", "/v1/db/test/bucket/food/update", `{"keystore":{"apple":"red"}}`); code != http.StatusOK {
+		t.Fatalf("Problem updating: %d %s", code, body)
+	}
+	db, release, err := s.getDB("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err == nil || !strings.Contains(err.Error(), "test: still being used") {
+		t.Errorf("Close should report databases that are still used: %v", err)
+	}
+	// The memory of the transaction is still mapped
+	if v := tx.Bucket([]byte("food")).Get([]byte("apple")); v == nil {
+		t.Errorf("Transaction should still read the database")
+	}
+	tx.Rollback()
+	release()
+	if stats := s.CacheStats(); stats.Open != 0 {
+		t.Errorf("Database should be closed once released: %+v", stats)
+	}
+}
+
+type slowBody struct {
+	*io.PipeReader
+	writer  *io.PipeWriter
+	reading chan struct{}
+	once    sync.Once
+}
+
+func newSlowBody() *slowBody {
+	r, w := io.Pipe()
+	return &slowBody{PipeReader: r, writer: w, reading: make(chan struct{})}
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	b.once.Do(func() { close(b.reading) })
+	return b.PipeReader.Read(p)
+}
+
+func (b *slowBody) send(body string) {
+	go func() {
+		b.writer.Write([]byte(body))
+		b.writer.Close()
+	}()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+// ndjsonContentType is the Accept header that asks /all, /keys and /range to
+// stream their entries as newline delimited JSON
+const ndjsonContentType = "application/x-ndjson"
+
+// streamLine is a line of a stream, which is an entry, or the last line with
+// the continuation token of a range that stopped at its limit, or the last
+// line with an error that happened after the stream started
+type streamLine struct {
+	Key   string       `json:"key,omitempty"`
+	Value *string      `json:"value,omitempty"` // nil for /keys
+	Next  string       `json:"next,omitempty"`
+	Error *streamError `json:"error,omitempty"`
+}
+
+// streamError is an error that happened after a stream started, with the
+// status it would have had as a response
+type streamError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// wantsStream returns whether the request accepts an NDJSON stream
+func wantsStream(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), ndjsonContentType)
+}
+
+// streamRange writes the keys of a range of a bucket, with their values
+// unless keysOnly, to w as NDJSON lines while reading them from the cursor,
+// so that the entries are never all held in memory
+func (s *Server) streamRange(w http.ResponseWriter, dbname string, bucket string, q rangeQuery, keysOnly bool) error {
+	var token []byte
+	if q.Token != "" {
+		var err error
+		if token, err = decodeRangeToken(q.Token); err != nil {
+			return err
+		}
+	}
+
+	db, release, err := s.getExistingDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The header is set once there is a line, so errors before then are
+	// sent as usual
+	enc := json.NewEncoder(w)
+	started := false
+	write := func(line streamLine) error {
+		if !started {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			started = true
+		}
+		return enc.Encode(line)
+	}
+
+	var next string
+	err = db.View(func(tx *bolt.Tx) error {
+		next, err = scanRange(tx, bucket, q, token, func(k, v []byte) error {
+			if s.closed() {
+				return errShuttingDown
+			}
+			line := streamLine{Key: string(k)}
+			if !keysOnly {
+				value, err := s.decodeValue(v)
+				if err != nil {
+					return corruptValue(bucket, string(k), err)
+				}
+				line.Value = &value
+			}
+			return write(line)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		return write(streamLine{Next: next})
+	}
+	if !started {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+	return nil
+}
+
+// respondStream streams a range of a bucket, ending the stream with an
+// error line if it fails after it started
+func (s *Server) respondStream(c *gin.Context, dbname string, bucket string, q rangeQuery, keysOnly bool) {
+	err := s.streamRange(c.Writer, dbname, bucket, q, keysOnly)
+	if err == nil {
+		return
+	}
+	if !c.Writer.Written() {
+		respondError(c, err)
+		return
+	}
+	e, ok := err.(*apiError)
+	if !ok {
+		c.Error(err)
+		e = &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Message: err.Error()}
+	}
+	json.NewEncoder(c.Writer).Encode(streamLine{Error: &streamError{e.Status, e.Code, e.Message}})
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// txOp is a single operation of a transaction, where Op is one of put,
+// delete, move, create_bucket or delete_bucket.
+type txOp struct {
+	Op         string            `json:"op"`
+	Bucket     string            `json:"bucket"`
+	Keystore   map[string]string `json:"keystore"`
+	TTL        string            `json:"ttl"`
+	TTLs       map[string]string `json:"ttls"`
+	Keys       []string          `json:"keys"`
+	FromBucket string            `json:"from_bucket"`
+	ToBucket   string            `json:"to_bucket"`
+
+	ttls map[string]time.Duration
+}
+
+// txPrecondition is a check on a key that must pass before any operations
+// of a transaction are applied. Exists checks whether the key exists, and
+// Value and Version check that the key exists with the value or version.
+type txPrecondition struct {
+	Bucket  string  `json:"bucket"`
+	Key     string  `json:"key"`
+	Exists  *bool   `json:"exists"`
+	Value   *string `json:"value"`
+	Version *uint64 `json:"version"`
+}
+
+// txJSON is a transaction whose operations are applied in order, all or
+// nothing, if every precondition holds
+type txJSON struct {
+	Preconditions []txPrecondition `json:"preconditions"`
+	Ops           []txOp           `json:"ops"`
+}
+
+// preconditionError is returned when a precondition of a transaction fails
+type preconditionError struct {
+	Precondition txPrecondition
+}
+
+func (e *preconditionError) Error() string {
+	p := e.Precondition
+	switch {
+	case p.Version != nil:
+		return fmt.Sprintf("Precondition failed: '%s' in '%s' does not have version %d", p.Key, p.Bucket, *p.Version)
+	case p.Value != nil:
+		return fmt.Sprintf("Precondition failed: '%s' in '%s' does not have value '%s'", p.Key, p.Bucket, *p.Value)
+	case *p.Exists:
+		return fmt.Sprintf("Precondition failed: '%s' does not exist in '%s'", p.Key, p.Bucket)
+	default:
+		return fmt.Sprintf("Precondition failed: '%s' exists in '%s'", p.Key, p.Bucket)
+	}
+}
+
+// validate checks that the transaction is well formed before it is run
+func (t *txJSON) validate() error {
+	for i, p := range t.Preconditions {
+		if p.Bucket == "" || p.Key == "" {
+			return badRequest("Precondition %d must specify bucket and key", i)
+		}
+		if err := validateBucketName(p.Bucket); err != nil {
+			return prefixError(fmt.Sprintf("Precondition %d", i), err)
+		}
+		if p.Exists == nil && p.Value == nil && p.Version == nil {
+			return badRequest("Precondition %d must specify exists, value or version", i)
+		}
+	}
+	if len(t.Ops) == 0 {
+		return badRequest("Must provide ops")
+	}
+	for i := range t.Ops {
+		op := &t.Ops[i]
+		switch op.Op {
+		case "put":
+			if op.Bucket == "" || op.Keystore == nil {
+				return badRequest("Op %d (put) must specify bucket and keystore", i)
+			}
+			var err error
+			op.ttls, err = updateJSON{Keystore: op.Keystore, TTL: op.TTL, TTLs: op.TTLs}.parseTTLs()
+			if err != nil {
+				return prefixError(fmt.Sprintf("Op %d (put)", i), err)
+			}
+		case "delete":
+			if op.Bucket == "" {
+				return badRequest("Op %d (delete) must specify bucket", i)
+			}
+		case "move":
+			if op.FromBucket == "" || op.ToBucket == "" {
+				return badRequest("Op %d (move) must specify from_bucket and to_bucket", i)
+			}
+		case "create_bucket", "delete_bucket":
+			if op.Bucket == "" {
+				return badRequest("Op %d (%s) must specify bucket", i, op.Op)
+			}
+		default:
+			return badRequest("Op %d has unknown op '%s'", i, op.Op)
+		}
+		buckets := []string{op.Bucket}
+		if op.Op == "move" {
+			buckets = []string{op.FromBucket, op.ToBucket}
+		}
+		if err := validateBucketNames(buckets...); err != nil {
+			return prefixError(fmt.Sprintf("Op %d (%s)", i, op.Op), err)
+		}
+	}
+	return nil
+}
+
+// checkPrecondition returns a *preconditionError if the precondition does not hold
+func (s *Server) checkPrecondition(tx *bolt.Tx, p txPrecondition) error {
+	var v []byte
+	var m keyMeta
+	if b := resolveBucket(tx, p.Bucket); b != nil {
+		v = b.Get([]byte(p.Key))
+		m = readKeyMeta(keyMetaBucket(tx, p.Bucket), []byte(p.Key))
+		if v != nil && m.expired(time.Now()) {
+			v = nil
+		}
+	}
+	if p.Exists != nil && *p.Exists != (v != nil) {
+		return &preconditionError{p}
+	}
+	if p.Value != nil {
+		if v == nil {
+			return &preconditionError{p}
+		}
+		value, err := s.decodeValue(v)
+		if err != nil {
+			return corruptValue(p.Bucket, p.Key, err)
+		}
+		if value != *p.Value {
+			return &preconditionError{p}
+		}
+	}
+	if p.Version != nil && (v == nil || m.Version != *p.Version) {
+		return &preconditionError{p}
+	}
+	return nil
+}
+
+// runTransaction checks the preconditions and applies the operations of a
+// validated transaction in a single bolt transaction.
+func (s *Server) runTransaction(dbname string, t txJSON) error {
+	db, release, err := s.getDB(dbname)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, p := range t.Preconditions {
+			if err := s.checkPrecondition(tx, p); err != nil {
+				return err
+			}
+		}
+		for i, op := range t.Ops {
+			var err error
+			switch op.Op {
+			case "put":
+				_, err = s.putKeysInTx(tx, op.Bucket, op.Keystore, op.ttls)
+			case "delete":
+				err = deleteKeysInTx(tx, op.Bucket, op.Keys)
+			case "move":
+				err = moveKeysInTx(tx, op.FromBucket, op.ToBucket, op.Keys)
+			case "create_bucket":
+				err = createBucketsInTx(tx, []string{op.Bucket})
+			case "delete_bucket":
+				err = deleteBucketInTx(tx, op.Bucket)
+			}
+			if err != nil {
+				return prefixError(fmt.Sprintf("Op %d (%s) failed", i, op.Op), err)
+			}
+		}
+		return nil
+	})
+}
+
+// events returns the events for the operations of a transaction
+func (t *txJSON) events(dbname string) []event {
+	events := []event{}
+	for _, op := range t.Ops {
+		switch op.Op {
+		case "put":
+			for key, value := range op.Keystore {
+				events = append(events, event{Type: "put", DB: dbname, Bucket: op.Bucket, Key: key, Value: value})
+			}
+		case "delete":
+			for _, key := range op.Keys {
+				events = append(events, event{Type: "delete", DB: dbname, Bucket: op.Bucket, Key: key})
+			}
+		case "move":
+			for _, key := range op.Keys {
+				events = append(events, event{Type: "move", DB: dbname, Bucket: op.FromBucket, Key: key, ToBucket: op.ToBucket})
+			}
+		case "delete_bucket":
+			events = append(events, event{Type: "delete_bucket", DB: dbname, Bucket: op.Bucket})
+		}
+	}
+	return events
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// formatETag returns the ETag for a version of a key
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseETag returns the version of a key from its ETag
+func parseETag(etag string) (uint64, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, errors.New("Problem parsing ETag " + etag)
+	}
+	return strconv.ParseUint(etag[1:len(etag)-1], 10, 64)
+}
+
+// matchETag returns whether an If-Match or If-None-Match header matches the ETag
+func matchETag(header string, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// event is a change made to a database, where Type is one of put, delete,
+// move, pop or delete_bucket
+type event struct {
+	Type     string    `json:"type"`
+	DB       string    `json:"db"`
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	ToBucket string    `json:"to_bucket,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// watcher receives the events of a database, optionally only those of a
+// bucket and keys with a prefix. Its channel is closed if it falls too far
+// behind.
+type watcher struct {
+	dbname string
+	bucket string
+	prefix string
+	events chan event
+}
+
+// watcherBufferSize is the number of events a watcher can fall behind by
+const watcherBufferSize = 1000
+
+func (s *Server) addWatcher(dbname string, bucket string, prefix string) *watcher {
+	w := &watcher{
+		dbname: dbname,
+		bucket: bucket,
+		prefix: prefix,
+		events: make(chan event, watcherBufferSize),
+	}
+	s.watchers.Lock()
+	s.watchers.data[w] = true
+	s.watchers.Unlock()
+	return w
+}
+
+func (s *Server) removeWatcher(w *watcher) {
+	s.watchers.Lock()
+	if _, ok := s.watchers.data[w]; ok {
+		delete(s.watchers.data, w)
+		close(w.events)
+	}
+	s.watchers.Unlock()
+}
+
+// removeAllWatchers ends every watch stream
+func (s *Server) removeAllWatchers() {
+	s.watchers.Lock()
+	for w := range s.watchers.data {
+		delete(s.watchers.data, w)
+		close(w.events)
+	}
+	s.watchers.Unlock()
+}
+
+// matches returns whether the watcher wants the event
+func (w *watcher) matches(e event) bool {
+	if w.dbname != e.DB {
+		return false
+	}
+	if w.bucket != "" && !inBucket(e.Bucket, w.bucket) && (e.ToBucket == "" || !inBucket(e.ToBucket, w.bucket)) {
+		return false
+	}
+	return strings.HasPrefix(e.Key, w.prefix)
+}
+
+// publish sends the events to every watcher that wants them. Watchers that
+// are too far behind are removed, so publishing never blocks.
+func (s *Server) publish(events ...event) {
+	now := time.Now()
+	s.watchers.Lock()
+	defer s.watchers.Unlock()
+	if len(s.watchers.data) == 0 {
+		return
+	}
+	for _, e := range events {
+		e.Time = now
+		for w := range s.watchers.data {
+			if !w.matches(e) {
+				continue
+			}
+			select {
+			case w.events <- e:
+			default:
+				s.log.Warn("Watcher of %s fell behind, closing it", w.dbname)
+				delete(s.watchers.data, w)
+				close(w.events)
+			}
+		}
+	}
+}
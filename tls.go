@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// clientAuthTypes are the values of tls.client_auth, which choose whether
+// clients must have a certificate signed by tls.client_ca
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// tlsReloader holds the certificate and client CAs of the server, which can
+// be read again on SIGHUP so that certificates are renewed without a restart
+type tlsReloader struct {
+	certFile   string
+	keyFile    string
+	clientCA   string
+	clientAuth tls.ClientAuthType
+
+	mu      sync.RWMutex
+	current *tls.Config
+}
+
+// newTLSReloader loads the certificates in the TLS settings of the config
+func newTLSReloader(conf config) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile:   conf.TLS.Cert,
+		keyFile:    conf.TLS.Key,
+		clientCA:   conf.TLS.ClientCA,
+		clientAuth: clientAuthTypes[conf.TLS.ClientAuth],
+	}
+	if r.clientCA != "" && conf.TLS.ClientAuth == "" {
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return r, r.reload()
+}
+
+// reload reads the certificates again, keeping the previous ones if they
+// can't be read. Connections that are already open keep their certificates.
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Problem loading TLS certificate: %s", err.Error())
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+	}
+	if r.clientCA != "" {
+		pem, err := ioutil.ReadFile(r.clientCA)
+		if err != nil {
+			return fmt.Errorf("Problem loading client CA: %s", err.Error())
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Problem loading client CA: no certificates in %s", r.clientCA)
+		}
+	}
+
+	r.mu.Lock()
+	r.current = config
+	r.mu.Unlock()
+	return nil
+}
+
+// tlsConfig returns the config to serve with, which uses the latest
+// certificates for each new connection
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	get := func() *tls.Config {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.current
+	}
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &get().Certificates[0], nil
+		},
+	}
+	// Each connection gets a copy of base, so that it keeps offering HTTP/2
+	// and only the reloaded settings change
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		current := get()
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.Certificates = current.Certificates
+		config.ClientAuth = current.ClientAuth
+		config.ClientCAs = current.ClientCAs
+		return config, nil
+	}
+	return base
+}